@@ -2,10 +2,14 @@ package batch
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"log"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/timberio/timber-go/compress"
 	"github.com/timberio/timber-go/logging"
 )
 
@@ -15,6 +19,15 @@ var (
 	defaultBufferSize = 990000
 
 	defaultPeriod = 3 * time.Second
+
+	// Buffers held back by MinFill are sent after this many periods.
+	defaultMaxAgePeriods = 10
+
+	// When compressing, buffers may hold up to this many times Size of raw logs.
+	defaultRawSizeRatio = 10
+
+	// ErrClosed is returned by Flush once the batcher has shut down.
+	ErrClosed = errors.New("batch: batcher is closed")
 )
 
 type Batcher struct {
@@ -22,12 +35,62 @@ type Batcher struct {
 	ByteChan   chan []byte
 
 	Config
+
+	input       chan []byte
+	flushChan   chan chan int64
+	intakeFlush chan chan int64
+	closing     chan struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+	counters    counters
+	pool        sync.Pool
+	releases    releases
 }
 
 type Config struct {
 	Period time.Duration
 	Size   int
 
+	// MaxLines, when set, sends a buffer as soon as it holds this many lines.
+	MaxLines int
+	// MinFill is the number of bytes a buffer must hold before Period sends
+	// it. Buffers below it wait for the next tick, until their first line is
+	// MaxAge old.
+	MinFill int
+	// MaxAge is how long a buffer held back by MinFill may wait before Period
+	// sends it anyway. It defaults to ten times Period.
+	MaxAge time.Duration
+	// IdleTimeout, when set, sends the buffer once no line has arrived for
+	// this long.
+	IdleTimeout time.Duration
+
+	// Compression, when set, makes Size limit the compressed size of each
+	// buffer instead of its raw size. It should match the codec used by the
+	// forwarder, which remains responsible for compressing the buffer.
+	Compression compress.Codec
+	// MaxRawSize limits the uncompressed size of each buffer when Compression
+	// is set. It defaults to ten times Size.
+	MaxRawSize int
+
+	// Oversize decides what happens to lines too large to fit in a buffer.
+	Oversize OversizePolicy
+	// OnOversize, when set, is called for every line handled by the Oversize
+	// policy instead of logging it.
+	OnOversize func(OversizeEvent)
+
+	// Overflow decides what happens when lines arrive faster than they can
+	// be batched. With any policy other than OverflowBlock, lines are held in
+	// a queue of up to QueueSize lines so that senders never wait.
+	Overflow   OverflowPolicy
+	QueueSize  int
+	SampleRate int
+
+	// WaitForRelease makes Flush and Close wait until the buffers they send
+	// have been passed to Release, which forward.ForwardWithConfig does once
+	// a buffer has been forwarded, instead of returning as soon as they are
+	// received from BufferChan. Every buffer must then be released.
+	WaitForRelease bool
+
 	Logger logging.Logger
 }
 
@@ -36,6 +99,9 @@ func DefaultConfig() Config {
 		Period: defaultPeriod,
 		Size:   defaultBufferSize,
 
+		QueueSize:  defaultQueueSize,
+		SampleRate: defaultSampleRate,
+
 		Logger: log.New(os.Stderr, "", log.LstdFlags),
 	}
 }
@@ -51,14 +117,53 @@ func NewBatcher(byteChan chan []byte, config Config) *Batcher {
 		config.Size = defaultConfig.Size
 	}
 
+	if config.MinFill > 0 && config.MaxAge == 0 {
+		config.MaxAge = config.Period * time.Duration(defaultMaxAgePeriods)
+	}
+
+	if config.Compression != nil && config.MaxRawSize == 0 {
+		config.MaxRawSize = config.Size * defaultRawSizeRatio
+	}
+
+	if config.QueueSize == 0 {
+		config.QueueSize = defaultConfig.QueueSize
+	}
+
+	if config.SampleRate == 0 {
+		config.SampleRate = defaultConfig.SampleRate
+	}
+
 	if config.Logger == nil {
 		config.Logger = defaultConfig.Logger
 	}
 
+	return startBatcher(byteChan, config)
+}
+
+func Batch(byteChan chan []byte) *Batcher {
+	return startBatcher(byteChan, DefaultConfig())
+}
+
+func startBatcher(byteChan chan []byte, config Config) *Batcher {
 	batcher := &Batcher{
 		BufferChan: make(chan *bytes.Buffer),
 		ByteChan:   byteChan,
 		Config:     config,
+
+		input:       byteChan,
+		flushChan:   make(chan chan int64),
+		intakeFlush: make(chan chan int64),
+		closing:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	batcher.pool.New = func() interface{} {
+		return freshBuffer(config.Size)
+	}
+
+	if config.Overflow != OverflowBlock {
+		batcher.input = make(chan []byte)
+		go batcher.intake(batcher.input)
 	}
 
 	go batcher.batch()
@@ -66,63 +171,294 @@ func NewBatcher(byteChan chan []byte, config Config) *Batcher {
 	return batcher
 }
 
-func Batch(byteChan chan []byte) *Batcher {
-	batcher := &Batcher{
-		BufferChan: make(chan *bytes.Buffer),
-		ByteChan:   byteChan,
-		Config:     DefaultConfig(),
+// Flush sends the in-progress buffer, if any, to BufferChan and returns once it
+// has been received downstream (typically by the forward.Forward loop), or
+// once it has been released when WaitForRelease is set. It returns ctx.Err()
+// if the context expires first, and ErrClosed if the batcher has already shut
+// down.
+func (batcher *Batcher) Flush(ctx context.Context) error {
+	// Buffered so that the batch loop never waits for an abandoned Flush
+	flushed := make(chan int64, 1)
+
+	// Lines waiting in the overflow queue must reach the buffer first
+	requests := batcher.flushChan
+	if batcher.Overflow != OverflowBlock {
+		requests = batcher.intakeFlush
 	}
 
-	go batcher.batch()
+	select {
+	case requests <- flushed:
+	case <-batcher.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
-	return batcher
+	select {
+	case sent := <-flushed:
+		if batcher.WaitForRelease {
+			return batcher.releases.wait(ctx, sent)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (batcher *Batcher) batch() {
-	buffer := freshBuffer(batcher.Size)
-	tick := time.Tick(batcher.Period)
+// Close stops receiving from ByteChan, sends the remaining buffer downstream
+// and waits until BufferChan has been closed, and every buffer has been
+// released when WaitForRelease is set. Lines already buffered in ByteChan are
+// still batched, but nothing may be sent on ByteChan after calling Close.
+// ByteChan is left open, so callers that close it themselves may still do so.
+// It returns ctx.Err() if the context expires before the final buffer has been
+// received downstream.
+func (batcher *Batcher) Close(ctx context.Context) error {
+	batcher.closeOnce.Do(func() {
+		close(batcher.closing)
+	})
 
+	select {
+	case <-batcher.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if batcher.WaitForRelease {
+		return batcher.releases.wait(ctx, batcher.releases.sequence())
+	}
+
+	return nil
+}
+
+// drain passes every line still buffered in ByteChan to handle, returning as
+// soon as receiving would block or ByteChan is closed.
+func (batcher *Batcher) drain(handle func([]byte)) {
 	for {
 		select {
 		case b, ok := <-batcher.ByteChan:
-			if ok {
-				if len(b)+1 > buffer.Cap() {
-					// @TODO track souce?
-					// @TODO more informative log line
-					// have callback channel for results
-					batcher.Logger.Print("Dropping log line greater than the max buffer size")
-					continue
-				}
-
-				if buffer.Len()+len(b)+1 > buffer.Cap() {
-					batcher.BufferChan <- buffer
-					buffer = freshBuffer(batcher.Size)
-				}
-
-				if len(b) > 0 {
-					b = append(b, []byte("\n")...)
-					buffer.Write(b)
-				}
-
-			} else { // channel is closed
-				if buffer.Len() > 0 {
-					batcher.BufferChan <- buffer
-				}
-				close(batcher.BufferChan)
+			if !ok {
 				return
 			}
+			handle(b)
+		default:
+			return
+		}
+	}
+}
+
+func (batcher *Batcher) batch() {
+	defer close(batcher.done)
+
+	buffer := batcher.freshBuffer()
+	ticker := time.NewTicker(batcher.Period)
+	defer ticker.Stop()
+
+	sizer := newSizer(batcher.Config)
+	defer sizer.close()
+
+	// The idle timer only runs while lines are arriving
+	var idle <-chan time.Time
+	idleTimer := time.NewTimer(time.Hour)
+	idleTimer.Stop()
+	defer idleTimer.Stop()
+
+	lines := 0
+	// When the first line of the buffer was written
+	var started time.Time
 
-		case <-tick:
+	send := func() {
+		if batcher.WaitForRelease {
+			batcher.releases.sent(buffer)
+		}
+		batcher.BufferChan <- buffer
+		buffer = batcher.freshBuffer()
+		sizer.reset()
+		lines = 0
+	}
+
+	write := func(b []byte) {
+		if !sizer.fits(buffer, b) {
+			send()
+		}
+
+		if len(b) > 0 {
+			if buffer.Len() == 0 {
+				started = time.Now()
+			}
+			buffer.Write(b)
+			buffer.WriteByte('\n')
+			sizer.add(b)
+			lines++
+		}
+
+		if batcher.MaxLines > 0 && lines >= batcher.MaxLines {
+			send()
+		}
+	}
+
+	receive := func(b []byte) {
+		if batcher.IdleTimeout > 0 {
+			resetTimer(idleTimer, batcher.IdleTimeout)
+			idle = idleTimer.C
+		}
+
+		if sizer.oversized(b) {
+			for _, chunk := range batcher.oversize(b, sizer.limit()) {
+				write(chunk)
+			}
+			return
+		}
+
+		write(b)
+	}
+
+	// The intake goroutine handles Close itself when there is one
+	closing := batcher.closing
+	if batcher.Overflow != OverflowBlock {
+		closing = nil
+	}
+
+	for {
+		select {
+		case b, ok := <-batcher.input:
+			if ok {
+				receive(b)
+				continue
+			}
+
+		case <-closing:
+			batcher.drain(receive)
+
+		case flushed := <-batcher.flushChan:
+			if buffer.Len() > 0 {
+				send()
+			}
+			flushed <- batcher.releases.sequence()
+			continue
+
+		case <-ticker.C:
+			if buffer.Len() > 0 && (buffer.Len() >= batcher.MinFill || time.Since(started) >= batcher.MaxAge) {
+				send()
+			}
+			continue
+
+		case <-idle:
+			idle = nil
 			if buffer.Len() > 0 {
-				batcher.BufferChan <- buffer
-				buffer = freshBuffer(batcher.Size)
+				send()
 			}
+			continue
 		}
+
+		// ByteChan is closed or Close was called
+		if buffer.Len() > 0 {
+			if batcher.WaitForRelease {
+				batcher.releases.sent(buffer)
+			}
+			batcher.BufferChan <- buffer
+		}
+		close(batcher.BufferChan)
+		return
 	}
 }
 
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// freshBuffer returns an empty buffer, reusing one passed to Release when
+// possible.
+func (batcher *Batcher) freshBuffer() *bytes.Buffer {
+	return batcher.pool.Get().(*bytes.Buffer)
+}
+
+// Release returns a buffer received from BufferChan to the batcher so that it
+// can be reused for a later batch instead of allocating a new one. The buffer
+// must not be used after calling Release. It is safe to call from any
+// goroutine, and is typically passed as forward.ForwardConfig.Release.
+func (batcher *Batcher) Release(buffer *bytes.Buffer) {
+	batcher.releases.released(buffer)
+	buffer.Reset()
+	batcher.pool.Put(buffer)
+}
+
 func freshBuffer(size int) *bytes.Buffer {
 	buf := bytes.NewBuffer(make([]byte, size))
 	buf.Reset()
 	return buf
 }
+
+// releases tracks the buffers sent on BufferChan that have not been released
+// yet, so that Flush and Close can wait for them when WaitForRelease is set.
+type releases struct {
+	mutex   sync.Mutex
+	next    int64
+	pending map[*bytes.Buffer]int64
+	// Closed and replaced whenever a buffer is released
+	changed chan struct{}
+}
+
+// sent records buffer as the next buffer sent on BufferChan.
+func (r *releases) sent(buffer *bytes.Buffer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.pending == nil {
+		r.pending = map[*bytes.Buffer]int64{}
+		r.changed = make(chan struct{})
+	}
+
+	r.next++
+	r.pending[buffer] = r.next
+}
+
+func (r *releases) released(buffer *bytes.Buffer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.pending[buffer]; ok {
+		delete(r.pending, buffer)
+		close(r.changed)
+		r.changed = make(chan struct{})
+	}
+}
+
+// sequence is the number of buffers recorded by sent so far.
+func (r *releases) sequence() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.next
+}
+
+// wait returns once every buffer up to sequence has been released.
+func (r *releases) wait(ctx context.Context, sequence int64) error {
+	for {
+		r.mutex.Lock()
+		waiting := false
+		for _, seq := range r.pending {
+			if seq <= sequence {
+				waiting = true
+				break
+			}
+		}
+		changed := r.changed
+		r.mutex.Unlock()
+
+		if !waiting {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
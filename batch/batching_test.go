@@ -2,8 +2,15 @@ package batch
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/timberio/timber-go/compress"
 )
 
 func TestChannelClosing(t *testing.T) {
@@ -66,3 +73,612 @@ func TestBatchDropLogLine(t *testing.T) {
 		t.Fatalf("expected \"%+v\" to be nil", actual)
 	}
 }
+
+// Flush()
+// A partial buffer should be sent downstream without waiting for the period
+func TestFlush(t *testing.T) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period: 10 * time.Second,
+	})
+
+	batcher.ByteChan <- []byte("test log line")
+
+	received := make(chan *bytes.Buffer, 1)
+	go func() {
+		received <- <-batcher.BufferChan
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := batcher.Flush(ctx); err != nil {
+		t.Fatalf("expected flush to succeed, got %s", err)
+	}
+
+	actual := <-received
+	expected := "test log line\n"
+	if actual.String() != expected {
+		t.Fatalf("expected \"%+v\", got \"%+v\"", expected, actual)
+	}
+}
+
+// Flush()
+// Lines still in the overflow queue when Flush is called should be included
+func TestFlushOverflowQueue(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		byteChan := make(chan []byte)
+		batcher := NewBatcher(byteChan, Config{
+			Period:   10 * time.Second,
+			Size:     8,
+			Overflow: OverflowDropNewest,
+		})
+
+		// The batch loop blocks sending the first buffer, so the last line
+		// waits in the queue
+		for _, line := range []string{"aaa", "bbb", "ccc", "ddd"} {
+			batcher.ByteChan <- []byte(line)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		flushed := make(chan error, 1)
+		go func() {
+			flushed <- batcher.Flush(ctx)
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		var lines []string
+	receive:
+		for {
+			select {
+			case buffer := <-batcher.BufferChan:
+				lines = append(lines, strings.Fields(buffer.String())...)
+			case err := <-flushed:
+				if err != nil {
+					t.Fatalf("expected flush to succeed, got %s", err)
+				}
+				break receive
+			}
+		}
+		cancel()
+
+		if strings.Join(lines, " ") != "aaa bbb ccc ddd" {
+			t.Fatalf("expected every line before the flush to be sent, got %+v", lines)
+		}
+
+		close(batcher.ByteChan)
+	}
+}
+
+// Close()
+// The remaining buffer should be sent downstream and BufferChan closed
+func TestClose(t *testing.T) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period: 10 * time.Second,
+	})
+
+	batcher.ByteChan <- []byte("test log line")
+
+	var buffers []*bytes.Buffer
+	consumed := make(chan struct{})
+	go func() {
+		for buffer := range batcher.BufferChan {
+			buffers = append(buffers, buffer)
+		}
+		close(consumed)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := batcher.Close(ctx); err != nil {
+		t.Fatalf("expected close to succeed, got %s", err)
+	}
+	<-consumed
+
+	if len(buffers) != 1 || buffers[0].String() != "test log line\n" {
+		t.Fatalf("expected a single flushed buffer, got %+v", buffers)
+	}
+
+	if err := batcher.Flush(ctx); err != ErrClosed {
+		t.Fatalf("expected ErrClosed after close, got %v", err)
+	}
+}
+
+// Close()
+// When nothing consumes BufferChan, Close should give up at the deadline
+func TestCloseDeadline(t *testing.T) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period: 10 * time.Second,
+	})
+
+	batcher.ByteChan <- []byte("test log line")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := batcher.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline to be exceeded, got %v", err)
+	}
+}
+
+// Close()
+// Closing ByteChan before Close should not make Close panic, and lines still
+// buffered in ByteChan should be sent
+func TestCloseAfterByteChanClosed(t *testing.T) {
+	for _, overflow := range []OverflowPolicy{OverflowBlock, OverflowDropNewest} {
+		byteChan := make(chan []byte, 2)
+		batcher := NewBatcher(byteChan, Config{
+			Period:   10 * time.Second,
+			Overflow: overflow,
+		})
+
+		byteChan <- []byte("first")
+		byteChan <- []byte("second")
+		close(byteChan)
+
+		consumed := make(chan string)
+		go func() {
+			var lines []string
+			for buffer := range batcher.BufferChan {
+				lines = append(lines, strings.Fields(buffer.String())...)
+			}
+			consumed <- strings.Join(lines, " ")
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := batcher.Close(ctx); err != nil {
+			t.Fatalf("expected close to succeed, got %s", err)
+		}
+		cancel()
+
+		if lines := <-consumed; lines != "first second" {
+			t.Fatalf("expected every line to be sent, got %q", lines)
+		}
+	}
+}
+
+// Flush()
+// With WaitForRelease, Flush should wait until the buffer has been released
+func TestFlushWaitForRelease(t *testing.T) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period:         10 * time.Second,
+		WaitForRelease: true,
+	})
+
+	batcher.ByteChan <- []byte("test log line")
+
+	received := make(chan *bytes.Buffer)
+	go func() {
+		for buffer := range batcher.BufferChan {
+			received <- buffer
+		}
+	}()
+
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- batcher.Flush(context.Background())
+	}()
+
+	buffer := <-received
+
+	select {
+	case err := <-flushed:
+		t.Fatalf("expected flush to wait for the buffer to be released, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	batcher.Release(buffer)
+
+	if err := <-flushed; err != nil {
+		t.Fatalf("expected flush to succeed, got %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := batcher.Close(ctx); err != nil {
+		t.Fatalf("expected close to succeed, got %s", err)
+	}
+}
+
+// With compression, Size limits the compressed size so that far more raw
+// bytes fit in a single buffer
+func TestCompressedSize(t *testing.T) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period:      10 * time.Second,
+		Size:        100000,
+		Compression: compress.Gzip,
+	})
+
+	go func() {
+		filler := []byte("test log line")
+		for i := 0; i < 50000; i++ {
+			batcher.ByteChan <- filler
+		}
+		close(batcher.ByteChan)
+	}()
+
+	for buffer := range batcher.BufferChan {
+		if buffer.Len() > batcher.MaxRawSize {
+			t.Fatalf("expected at most %d raw bytes, got %d", batcher.MaxRawSize, buffer.Len())
+		}
+
+		var compressed bytes.Buffer
+		compress.Encode(compress.Gzip, &compressed, buffer.Bytes())
+		if compressed.Len() > batcher.Size {
+			t.Fatalf("expected at most %d compressed bytes, got %d", batcher.Size, compressed.Len())
+		}
+
+		if buffer.Len() <= batcher.Size {
+			t.Fatalf("expected more than %d raw bytes in a buffer, got %d", batcher.Size, buffer.Len())
+		}
+		return
+	}
+}
+
+// With compression, a line that does not compress below Size on its own
+// should be handled by the Oversize policy, while a compressible line of the
+// same length is batched as is
+func TestCompressedOversize(t *testing.T) {
+	var events []OversizeEvent
+
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period:      10 * time.Second,
+		Size:        1000,
+		Compression: compress.Gzip,
+		Oversize:    OversizeSplit,
+		OnOversize:  func(event OversizeEvent) { events = append(events, event) },
+	})
+
+	random := make([]byte, 2500)
+	rand.Read(random)
+
+	go func() {
+		batcher.ByteChan <- []byte(hex.EncodeToString(random))
+		batcher.ByteChan <- bytes.Repeat([]byte("x"), 5000)
+		close(batcher.ByteChan)
+	}()
+
+	for buffer := range batcher.BufferChan {
+		var compressed bytes.Buffer
+		compress.Encode(compress.Gzip, &compressed, buffer.Bytes())
+		if compressed.Len() > batcher.Size {
+			t.Fatalf("expected at most %d compressed bytes, got %d", batcher.Size, compressed.Len())
+		}
+	}
+
+	if len(events) != 1 || events[0].Size != 5000 || events[0].Chunks < 2 {
+		t.Fatalf("expected the random line to be split, got %+v", events)
+	}
+}
+
+// Oversized lines should be truncated with a marker and reported
+func TestOversizeTruncate(t *testing.T) {
+	var events []OversizeEvent
+
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period:     10 * time.Second,
+		Size:       32,
+		Oversize:   OversizeTruncate,
+		OnOversize: func(event OversizeEvent) { events = append(events, event) },
+	})
+
+	batcher.ByteChan <- bytes.Repeat([]byte("x"), 100)
+	close(batcher.ByteChan)
+
+	actual := <-batcher.BufferChan
+	expected := "xxxxxxxxxxxxxxxxx...[truncated]\n"
+	if actual.String() != expected {
+		t.Fatalf("expected \"%+v\", got \"%+v\"", expected, actual)
+	}
+
+	if len(events) != 1 || events[0].Size != 100 || events[0].Policy != OversizeTruncate {
+		t.Fatalf("expected a single truncate event for 100 bytes, got %+v", events)
+	}
+}
+
+// Oversized lines should be split into chunks sharing an ID
+func TestOversizeSplit(t *testing.T) {
+	var events []OversizeEvent
+
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period:     10 * time.Second,
+		Size:       64,
+		Oversize:   OversizeSplit,
+		OnOversize: func(event OversizeEvent) { events = append(events, event) },
+	})
+
+	line := bytes.Repeat([]byte("0123456789"), 10)
+	go func() {
+		batcher.ByteChan <- line
+		close(batcher.ByteChan)
+	}()
+
+	var reassembled []byte
+	chunks := 0
+	for buffer := range batcher.BufferChan {
+		if buffer.Len() > 64 {
+			t.Fatalf("expected buffers of at most 64 bytes, got %d", buffer.Len())
+		}
+
+		for _, chunk := range bytes.Split(bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), []byte("\n")) {
+			header := splitHeader(events[0].ID, chunks+1, events[0].Chunks)
+			if !bytes.HasPrefix(chunk, []byte(header)) {
+				t.Fatalf("expected chunk to start with \"%s\", got \"%s\"", header, chunk)
+			}
+			reassembled = append(reassembled, chunk[len(header):]...)
+			chunks++
+		}
+	}
+
+	if !bytes.Equal(reassembled, line) || chunks != events[0].Chunks {
+		t.Fatalf("expected %d chunks reassembling the line, got %d: \"%s\"", events[0].Chunks, chunks, reassembled)
+	}
+}
+
+func fillStalledBatcher(t *testing.T, policy OverflowPolicy) (*Batcher, []string) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period:    10 * time.Second,
+		Size:      8,
+		Overflow:  policy,
+		QueueSize: 5,
+	})
+
+	// Nothing reads BufferChan yet, so senders must not block regardless
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			batcher.ByteChan <- []byte(fmt.Sprintf("%03d", i))
+		}
+		close(batcher.ByteChan)
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected senders not to block")
+	}
+
+	var lines []string
+	for buffer := range batcher.BufferChan {
+		lines = append(lines, strings.Fields(buffer.String())...)
+	}
+
+	return batcher, lines
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	batcher, lines := fillStalledBatcher(t, OverflowDropNewest)
+
+	stats := batcher.Stats()
+	if stats.DroppedNewest == 0 || int(stats.DroppedNewest)+len(lines) != 100 {
+		t.Fatalf("expected dropped and delivered lines to add up to 100, got %d and %d", stats.DroppedNewest, len(lines))
+	}
+
+	if lines[0] != "000" {
+		t.Fatalf("expected the oldest line to be kept, got %+v", lines)
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	batcher, lines := fillStalledBatcher(t, OverflowDropOldest)
+
+	stats := batcher.Stats()
+	if stats.DroppedOldest == 0 || int(stats.DroppedOldest)+len(lines) != 100 {
+		t.Fatalf("expected dropped and delivered lines to add up to 100, got %d and %d", stats.DroppedOldest, len(lines))
+	}
+
+	if lines[len(lines)-1] != "099" {
+		t.Fatalf("expected the newest line to be kept, got %+v", lines)
+	}
+}
+
+func TestOverflowSample(t *testing.T) {
+	batcher, lines := fillStalledBatcher(t, OverflowSample)
+
+	stats := batcher.Stats()
+	if stats.DroppedSampled == 0 || int(stats.DroppedSampled)+len(lines) != 100 {
+		t.Fatalf("expected dropped and delivered lines to add up to 100, got %d and %d", stats.DroppedSampled, len(lines))
+	}
+
+	// Some lines arriving after the queue filled up should have been kept
+	if lines[len(lines)-1] < "050" {
+		t.Fatalf("expected sampled lines from the end of the input, got %+v", lines)
+	}
+}
+
+// MaxLines should send a buffer as soon as it holds enough lines
+func TestMaxLines(t *testing.T) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period:   10 * time.Second,
+		MaxLines: 2,
+	})
+
+	go func() {
+		for _, line := range []string{"one", "two", "three"} {
+			batcher.ByteChan <- []byte(line)
+		}
+	}()
+
+	actual := <-batcher.BufferChan
+	expected := "one\ntwo\n"
+	if actual.String() != expected {
+		t.Fatalf("expected \"%+v\", got \"%+v\"", expected, actual)
+	}
+}
+
+// IdleTimeout should send a partial buffer once input stops
+func TestIdleTimeout(t *testing.T) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period:      10 * time.Second,
+		IdleTimeout: 20 * time.Millisecond,
+	})
+
+	batcher.ByteChan <- []byte("test log line")
+
+	select {
+	case actual := <-batcher.BufferChan:
+		if actual.String() != "test log line\n" {
+			t.Fatalf("expected \"test log line\", got \"%+v\"", actual)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the idle timeout to send the buffer")
+	}
+}
+
+// MinFill should keep the period from sending small buffers
+func TestMinFill(t *testing.T) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period:  10 * time.Millisecond,
+		MinFill: 20,
+		MaxAge:  10 * time.Second,
+	})
+
+	batcher.ByteChan <- []byte("short")
+
+	select {
+	case actual := <-batcher.BufferChan:
+		t.Fatalf("expected buffer below MinFill to be held, got \"%+v\"", actual)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	batcher.ByteChan <- []byte("long enough to fill")
+
+	select {
+	case actual := <-batcher.BufferChan:
+		expected := "short\nlong enough to fill\n"
+		if actual.String() != expected {
+			t.Fatalf("expected \"%+v\", got \"%+v\"", expected, actual)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the period to send the buffer once filled")
+	}
+}
+
+// Buffers held back by MinFill should still be sent once they reach MaxAge
+func TestMinFillMaxAge(t *testing.T) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period:  10 * time.Millisecond,
+		MinFill: 20,
+	})
+
+	if batcher.MaxAge != 100*time.Millisecond {
+		t.Fatalf("expected MaxAge to default to ten periods, got %s", batcher.MaxAge)
+	}
+
+	batcher.ByteChan <- []byte("short")
+
+	select {
+	case actual := <-batcher.BufferChan:
+		if actual.String() != "short\n" {
+			t.Fatalf("expected \"short\", got \"%+v\"", actual)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the buffer to be sent once it reached MaxAge")
+	}
+}
+
+// Lines should be copied into the buffer without modifying the caller's slice
+func TestCallerSliceUnmodified(t *testing.T) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period: 10 * time.Second,
+	})
+
+	backing := []byte("test log lineXXXX")
+	batcher.ByteChan <- backing[:13]
+	close(batcher.ByteChan)
+
+	<-batcher.BufferChan
+	if string(backing) != "test log lineXXXX" {
+		t.Fatalf("expected caller's memory to be untouched, got \"%s\"", backing)
+	}
+}
+
+// Released buffers should be emptied so they can be reused for later batches
+func TestRelease(t *testing.T) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Period:   10 * time.Second,
+		MaxLines: 1,
+	})
+
+	batcher.ByteChan <- []byte("test log line")
+
+	buffer := <-batcher.BufferChan
+	batcher.Release(buffer)
+
+	if buffer.Len() != 0 {
+		t.Fatalf("expected a released buffer to be empty, got \"%+v\"", buffer)
+	}
+
+	if fresh := batcher.freshBuffer(); fresh.Len() != 0 || fresh.Cap() < batcher.Size {
+		t.Fatalf("expected an empty buffer of at least %d bytes, got %d/%d", batcher.Size, fresh.Len(), fresh.Cap())
+	}
+}
+
+func BenchmarkBatch(b *testing.B) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, DefaultConfig())
+
+	consumed := make(chan struct{})
+	go func() {
+		for buffer := range batcher.BufferChan {
+			batcher.Release(buffer)
+		}
+		close(consumed)
+	}()
+
+	line := []byte(`{"level":"info","message":"test log line"}`)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(line) + 1))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		batcher.ByteChan <- line
+	}
+	close(batcher.ByteChan)
+	<-consumed
+}
+
+func BenchmarkBatchCompressed(b *testing.B) {
+	byteChan := make(chan []byte)
+	batcher := NewBatcher(byteChan, Config{
+		Compression: compress.Gzip,
+	})
+
+	consumed := make(chan struct{})
+	go func() {
+		for buffer := range batcher.BufferChan {
+			batcher.Release(buffer)
+		}
+		close(consumed)
+	}()
+
+	line := []byte(`{"level":"info","message":"test log line"}`)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(line) + 1))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		batcher.ByteChan <- line
+	}
+	close(batcher.ByteChan)
+	<-consumed
+}
@@ -0,0 +1,164 @@
+package batch
+
+import (
+	"sync/atomic"
+)
+
+var (
+	defaultQueueSize  = 10000
+	defaultSampleRate = 10
+)
+
+// OverflowPolicy decides what happens when lines are sent on ByteChan faster
+// than they can be batched and forwarded.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes senders wait until the batcher is ready.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards incoming lines while the queue is full.
+	OverflowDropNewest
+	// OverflowDropOldest discards the oldest queued line to make room.
+	OverflowDropOldest
+	// OverflowSample keeps one in every SampleRate incoming lines while the
+	// queue is full, discarding the oldest queued line to make room for it.
+	OverflowSample
+)
+
+// Stats counts the lines the batcher has queued and discarded.
+type Stats struct {
+	// Queued is the number of lines waiting in the overflow queue.
+	Queued int64
+
+	DroppedNewest  int64
+	DroppedOldest  int64
+	DroppedSampled int64
+
+	// Oversized is the number of lines handled by the Oversize policy.
+	Oversized int64
+}
+
+type counters struct {
+	queued         int64
+	droppedNewest  int64
+	droppedOldest  int64
+	droppedSampled int64
+	oversized      int64
+	sampled        int64
+}
+
+// Stats returns a snapshot of the batcher's counters. It is safe to call while
+// the batcher is running.
+func (batcher *Batcher) Stats() Stats {
+	return Stats{
+		Queued:         atomic.LoadInt64(&batcher.counters.queued),
+		DroppedNewest:  atomic.LoadInt64(&batcher.counters.droppedNewest),
+		DroppedOldest:  atomic.LoadInt64(&batcher.counters.droppedOldest),
+		DroppedSampled: atomic.LoadInt64(&batcher.counters.droppedSampled),
+		Oversized:      atomic.LoadInt64(&batcher.counters.oversized),
+	}
+}
+
+// intake keeps receiving from ByteChan into a bounded queue, applying the
+// overflow policy when it is full, and feeds the queue to the batch loop
+// through out. Flush requests are passed on once every line queued before
+// them has been sent. It closes out once ByteChan is closed, or Close has been
+// called, and the queue is empty.
+func (batcher *Batcher) intake(out chan<- []byte) {
+	defer close(out)
+
+	type pendingFlush struct {
+		// Number of lines that must leave the queue first
+		after   int64
+		flushed chan int64
+	}
+
+	var queue [][]byte
+	var flushes []pendingFlush
+	var enqueued, dequeued int64
+	in := batcher.ByteChan
+	closing := batcher.closing
+
+	accept := func(b []byte) {
+		queued := len(queue)
+		var accepted bool
+		queue, accepted = batcher.enqueue(queue, b)
+		if accepted {
+			enqueued++
+			if len(queue) == queued {
+				// The oldest line was dropped to make room
+				dequeued++
+			}
+		}
+	}
+
+	for in != nil || len(queue) > 0 || len(flushes) > 0 {
+		var send chan<- []byte
+		var next []byte
+		var flush chan chan int64
+		var flushed chan int64
+
+		if len(flushes) > 0 && dequeued >= flushes[0].after {
+			flush = batcher.flushChan
+			flushed = flushes[0].flushed
+		} else if len(queue) > 0 {
+			send = out
+			next = queue[0]
+		}
+
+		select {
+		case b, ok := <-in:
+			if !ok {
+				in = nil
+				closing = nil
+				continue
+			}
+			accept(b)
+
+		case <-closing:
+			batcher.drain(accept)
+			in = nil
+			closing = nil
+
+		case f := <-batcher.intakeFlush:
+			flushes = append(flushes, pendingFlush{after: enqueued, flushed: f})
+
+		case send <- next:
+			queue[0] = nil
+			queue = queue[1:]
+			dequeued++
+
+		case flush <- flushed:
+			flushes = flushes[1:]
+		}
+
+		atomic.StoreInt64(&batcher.counters.queued, int64(len(queue)))
+	}
+}
+
+// enqueue adds b to the queue unless the overflow policy discards it.
+func (batcher *Batcher) enqueue(queue [][]byte, b []byte) ([][]byte, bool) {
+	if len(queue) < batcher.QueueSize {
+		return append(queue, b), true
+	}
+
+	switch batcher.Overflow {
+	case OverflowDropOldest:
+		atomic.AddInt64(&batcher.counters.droppedOldest, 1)
+		queue[0] = nil
+		return append(queue[1:], b), true
+
+	case OverflowSample:
+		atomic.AddInt64(&batcher.counters.droppedSampled, 1)
+		batcher.counters.sampled++
+		if batcher.counters.sampled%int64(batcher.SampleRate) == 0 {
+			queue[0] = nil
+			return append(queue[1:], b), true
+		}
+		return queue, false
+
+	default:
+		atomic.AddInt64(&batcher.counters.droppedNewest, 1)
+		return queue, false
+	}
+}
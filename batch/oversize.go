@@ -0,0 +1,145 @@
+package batch
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	// Appended to lines shortened by OversizeTruncate.
+	truncatedMarker = []byte("...[truncated]")
+
+	// Bytes of an oversized line copied into OversizeEvent.Prefix.
+	oversizePrefixSize = 256
+)
+
+// OversizePolicy decides what happens to a line that cannot fit in a buffer.
+type OversizePolicy int
+
+const (
+	// OversizeDrop discards the line.
+	OversizeDrop OversizePolicy = iota
+	// OversizeTruncate keeps the start of the line followed by a marker.
+	OversizeTruncate
+	// OversizeSplit breaks the line into continuation chunks, each prefixed
+	// with "[split <id> <n>/<total>] " so that they can be reassembled.
+	OversizeSplit
+)
+
+func (p OversizePolicy) String() string {
+	switch p {
+	case OversizeDrop:
+		return "drop"
+	case OversizeTruncate:
+		return "truncate"
+	case OversizeSplit:
+		return "split"
+	default:
+		return "unknown"
+	}
+}
+
+// OversizeEvent describes a line that was dropped or modified because it was
+// larger than a buffer.
+type OversizeEvent struct {
+	Policy OversizePolicy
+	// Size is the length of the original line in bytes.
+	Size int
+	// Prefix is a copy of the start of the original line, which helps to
+	// identify the component emitting it.
+	Prefix []byte
+
+	// ID and Chunks are set when the line was split.
+	ID     string
+	Chunks int
+}
+
+// oversize applies the configured policy to a line that does not fit in a
+// buffer of limit bytes, returning the lines to batch in its place.
+func (batcher *Batcher) oversize(line []byte, limit int) [][]byte {
+	atomic.AddInt64(&batcher.counters.oversized, 1)
+
+	prefixSize := oversizePrefixSize
+	if len(line) < prefixSize {
+		prefixSize = len(line)
+	}
+
+	event := OversizeEvent{
+		Policy: batcher.Oversize,
+		Size:   len(line),
+		Prefix: append([]byte(nil), line[:prefixSize]...),
+	}
+
+	var lines [][]byte
+	switch batcher.Oversize {
+	case OversizeTruncate:
+		keep := limit - 1 - len(truncatedMarker)
+		if keep > 0 {
+			truncated := make([]byte, 0, keep+len(truncatedMarker))
+			truncated = append(truncated, line[:keep]...)
+			lines = append(lines, append(truncated, truncatedMarker...))
+		}
+
+	case OversizeSplit:
+		event.ID = newSplitID()
+		lines = splitLine(line, limit, event.ID)
+		event.Chunks = len(lines)
+	}
+
+	if batcher.OnOversize != nil {
+		batcher.OnOversize(event)
+	} else {
+		batcher.Logger.Printf("Log line of %d bytes is greater than the max buffer size of %d bytes (%s): %q",
+			event.Size, limit-1, event.Policy, event.Prefix[:minInt(len(event.Prefix), 64)])
+	}
+
+	return lines
+}
+
+// splitLine breaks line into chunks which, including their header and the
+// trailing newline, each fit within limit bytes.
+func splitLine(line []byte, limit int, id string) [][]byte {
+	// Size headers for the largest possible chunk count
+	headerSize := len(splitHeader(id, len(line), len(line)))
+	chunkSize := limit - 1 - headerSize
+	if chunkSize <= 0 {
+		return nil
+	}
+
+	total := (len(line) + chunkSize - 1) / chunkSize
+	chunks := make([][]byte, 0, total)
+
+	for i := 0; i < total; i++ {
+		start := i * chunkSize
+		end := start + chunkSize
+		if end > len(line) {
+			end = len(line)
+		}
+
+		header := splitHeader(id, i+1, total)
+		chunk := make([]byte, 0, len(header)+end-start)
+		chunk = append(chunk, header...)
+		chunks = append(chunks, append(chunk, line[start:end]...))
+	}
+
+	return chunks
+}
+
+func splitHeader(id string, n, total int) string {
+	return fmt.Sprintf("[split %s %d/%d] ", id, n, total)
+}
+
+func newSplitID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
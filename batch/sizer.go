@@ -0,0 +1,177 @@
+package batch
+
+import (
+	"bytes"
+
+	"github.com/timberio/timber-go/compress"
+)
+
+var (
+	// Compressed output is only measured when the compressor is flushed, so
+	// estimates may be off by at most this many raw bytes.
+	estimateFlushSize = 32 * 1024
+
+	// Room for the compressed stream's trailer, which is only written on close.
+	estimateTrailerSize = 64
+
+	// Incompressible input grows by well under one byte in this many, the
+	// overhead of stored blocks.
+	estimateExpansionRatio = 8192
+
+	newline = []byte("\n")
+)
+
+// sizer decides whether another line fits in the buffer being built.
+type sizer interface {
+	// oversized reports whether line cannot fit in a buffer even on its own.
+	oversized(line []byte) bool
+	// limit is the largest number of raw bytes, including the newline, of a
+	// line that always fits in an empty buffer.
+	limit() int
+	fits(buffer *bytes.Buffer, line []byte) bool
+	add(line []byte)
+	reset()
+	close()
+}
+
+func newSizer(config Config) sizer {
+	if config.Compression == nil {
+		return rawSizer{size: config.Size}
+	}
+
+	s := &compressedSizer{
+		size:       config.Size,
+		maxRawSize: config.MaxRawSize,
+		codec:      config.Compression,
+	}
+	s.reset()
+
+	return s
+}
+
+// rawSizer limits the uncompressed size of each buffer.
+type rawSizer struct {
+	size int
+}
+
+func (s rawSizer) oversized(line []byte) bool {
+	return len(line)+1 > s.size
+}
+
+func (s rawSizer) limit() int {
+	return s.size
+}
+
+func (s rawSizer) fits(buffer *bytes.Buffer, line []byte) bool {
+	return buffer.Len()+len(line)+1 <= s.size
+}
+
+func (s rawSizer) add(line []byte) {}
+func (s rawSizer) reset()          {}
+func (s rawSizer) close()          {}
+
+// compressedSizer limits the compressed size of each buffer by feeding every
+// line through a compressor alongside the buffer and measuring its output.
+// Estimates err on the large side: bytes not yet flushed from the compressor
+// are counted at their raw size.
+type compressedSizer struct {
+	size       int
+	maxRawSize int
+	codec      compress.Codec
+
+	writer     compress.Writer
+	compressed countingWriter
+	pending    int
+}
+
+func (s *compressedSizer) oversized(line []byte) bool {
+	if len(line)+1 > s.maxRawSize {
+		return true
+	}
+
+	if maxCompressedSize(len(line)+1) <= s.size {
+		return false
+	}
+
+	// Only lines that might not compress enough are compressed on their own
+	var compressed countingWriter
+	writer, err := s.codec.NewWriter(&compressed)
+	if err != nil {
+		return true
+	}
+	writer.Write(line)
+	writer.Write(newline)
+	writer.Close()
+
+	return int(compressed) > s.size
+}
+
+// limit is the largest raw size that compresses to at most size, however
+// incompressible the line.
+func (s *compressedSizer) limit() int {
+	limit := (s.size - estimateTrailerSize) * estimateExpansionRatio / (estimateExpansionRatio + 1)
+	if limit > s.maxRawSize {
+		limit = s.maxRawSize
+	}
+	return limit
+}
+
+func maxCompressedSize(rawSize int) int {
+	return rawSize + rawSize/estimateExpansionRatio + estimateTrailerSize
+}
+
+func (s *compressedSizer) fits(buffer *bytes.Buffer, line []byte) bool {
+	if buffer.Len()+len(line)+1 > s.maxRawSize {
+		return false
+	}
+
+	// Lines that are not oversized always fit on their own
+	if buffer.Len() == 0 {
+		return true
+	}
+
+	estimate := int(s.compressed) + s.pending + len(line) + 1 + estimateTrailerSize
+	return estimate <= s.size
+}
+
+func (s *compressedSizer) add(line []byte) {
+	s.pending += len(line) + 1
+
+	if s.writer == nil {
+		return
+	}
+
+	s.writer.Write(line)
+	s.writer.Write(newline)
+
+	if s.pending >= estimateFlushSize && s.writer.Flush() == nil {
+		s.pending = 0
+	}
+}
+
+func (s *compressedSizer) reset() {
+	s.close()
+
+	s.compressed = 0
+	s.pending = 0
+
+	// Without a writer every byte is counted at its raw size
+	writer, err := s.codec.NewWriter(&s.compressed)
+	if err == nil {
+		s.writer = writer
+	}
+}
+
+func (s *compressedSizer) close() {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
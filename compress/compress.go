@@ -0,0 +1,90 @@
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// Gzip compresses payloads with gzip at the default compression level.
+	Gzip Codec = gzipCodec{level: gzip.DefaultCompression}
+	// Zstd compresses payloads with zstd at the default compression level.
+	Zstd Codec = zstdCodec{level: zstd.SpeedDefault}
+)
+
+// Codec creates compressing writers for a single Content-Encoding.
+type Codec interface {
+	// Encoding is the value sent in the Content-Encoding header.
+	Encoding() string
+	NewWriter(w io.Writer) (Writer, error)
+}
+
+// Writer is a compressing writer that can flush pending output.
+type Writer interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// ForEncoding returns the codec for a Content-Encoding name such as "gzip".
+func ForEncoding(encoding string) (Codec, error) {
+	switch encoding {
+	case Gzip.Encoding():
+		return Gzip, nil
+	case Zstd.Encoding():
+		return Zstd, nil
+	default:
+		return nil, fmt.Errorf("compress: unsupported encoding %q", encoding)
+	}
+}
+
+// Encode compresses src into dst.
+func Encode(codec Codec, dst io.Writer, src []byte) error {
+	writer, err := codec.NewWriter(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(src); err != nil {
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+// GzipLevel returns a gzip codec using one of the compress/gzip levels.
+func GzipLevel(level int) Codec {
+	return gzipCodec{level: level}
+}
+
+type gzipCodec struct {
+	level int
+}
+
+func (c gzipCodec) Encoding() string {
+	return "gzip"
+}
+
+func (c gzipCodec) NewWriter(w io.Writer) (Writer, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+// ZstdLevel returns a zstd codec using one of the zstd encoder levels.
+func ZstdLevel(level zstd.EncoderLevel) Codec {
+	return zstdCodec{level: level}
+}
+
+type zstdCodec struct {
+	level zstd.EncoderLevel
+}
+
+func (c zstdCodec) Encoding() string {
+	return "zstd"
+}
+
+func (c zstdCodec) NewWriter(w io.Writer) (Writer, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(c.level))
+}
@@ -0,0 +1,56 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestEncodeGzip(test *testing.T) {
+	var compressed bytes.Buffer
+	if err := Encode(Gzip, &compressed, []byte("test log line\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	reader, err := gzip.NewReader(&compressed)
+	if err != nil {
+		test.Fatal(err)
+	}
+	actual, _ := ioutil.ReadAll(reader)
+
+	if string(actual) != "test log line\n" {
+		test.Fatalf("expected \"test log line\", got \"%s\"", actual)
+	}
+}
+
+func TestEncodeZstd(test *testing.T) {
+	var compressed bytes.Buffer
+	if err := Encode(Zstd, &compressed, []byte("test log line\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	decoder, err := zstd.NewReader(&compressed)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer decoder.Close()
+	actual, _ := ioutil.ReadAll(decoder)
+
+	if string(actual) != "test log line\n" {
+		test.Fatalf("expected \"test log line\", got \"%s\"", actual)
+	}
+}
+
+func TestForEncoding(test *testing.T) {
+	codec, err := ForEncoding("zstd")
+	if err != nil || codec.Encoding() != "zstd" {
+		test.Fatalf("expected zstd codec, got %v (%v)", codec, err)
+	}
+
+	if _, err := ForEncoding("br"); err == nil {
+		test.Fatal("expected an error for an unsupported encoding")
+	}
+}
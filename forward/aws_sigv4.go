@@ -0,0 +1,234 @@
+package forward
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timberio/timber-go/metadata"
+)
+
+var (
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+	awsDateFormat       = "20060102T150405Z"
+
+	// Instance profile credentials are refreshed this long before they expire
+	awsCredentialsSkew = 5 * time.Minute
+)
+
+// AWSCredentials sign requests to AWS and S3-compatible services.
+// SessionToken is only set for temporary credentials.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// AWSCredentialsFromEnv reads credentials from the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables.
+func AWSCredentialsFromEnv() AWSCredentials {
+	return AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// AWSCredentialsFromEC2 fetches the temporary credentials of the instance
+// profile from the EC2 metadata service, with IMDSv2 when the service
+// supports it. They must be fetched again before the returned expiration.
+func AWSCredentialsFromEC2(client *metadata.EC2Client) (AWSCredentials, time.Time, error) {
+	role, err := client.GetMetadata("iam/security-credentials/")
+	if err != nil {
+		return AWSCredentials{}, time.Time{}, fmt.Errorf("could not find instance profile: %s", err)
+	}
+
+	// The first line names the role
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+
+	document, err := client.GetMetadata("iam/security-credentials/" + role)
+	if err != nil {
+		return AWSCredentials{}, time.Time{}, fmt.Errorf("could not fetch credentials of role %s: %s", role, err)
+	}
+
+	var response struct {
+		Code            string
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal([]byte(document), &response); err != nil {
+		return AWSCredentials{}, time.Time{}, fmt.Errorf("could not decode credentials of role %s: %s", role, err)
+	}
+
+	if response.Code != "Success" {
+		return AWSCredentials{}, time.Time{}, fmt.Errorf("credentials of role %s unavailable: %s", role, response.Code)
+	}
+
+	credentials := AWSCredentials{
+		AccessKeyID:     response.AccessKeyID,
+		SecretAccessKey: response.SecretAccessKey,
+		SessionToken:    response.Token,
+	}
+
+	return credentials, response.Expiration, nil
+}
+
+func (c AWSCredentials) empty() bool {
+	return c.AccessKeyID == "" || c.SecretAccessKey == ""
+}
+
+// awsCredentialsProvider returns the static credentials when they are set, or
+// the instance profile credentials fetched through ec2Client, fetching them
+// again when they are about to expire.
+type awsCredentialsProvider struct {
+	static    AWSCredentials
+	ec2Client *metadata.EC2Client
+
+	mutex       sync.Mutex
+	credentials AWSCredentials
+	expiration  time.Time
+}
+
+func newAWSCredentialsProvider(static AWSCredentials, ec2Client *metadata.EC2Client) *awsCredentialsProvider {
+	return &awsCredentialsProvider{
+		static:    static,
+		ec2Client: ec2Client,
+	}
+}
+
+func (p *awsCredentialsProvider) get() (AWSCredentials, error) {
+	if !p.static.empty() {
+		return p.static, nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.credentials.empty() || time.Now().Add(awsCredentialsSkew).After(p.expiration) {
+		credentials, expiration, err := AWSCredentialsFromEC2(p.ec2Client)
+		if err != nil {
+			return AWSCredentials{}, fmt.Errorf("no credentials: %s", err)
+		}
+
+		p.credentials = credentials
+		p.expiration = expiration
+	}
+
+	return p.credentials, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signAWSRequest adds AWS Signature Version 4 headers to req, signing the
+// host and every header already set. payloadHash is the hex SHA-256 of the
+// body.
+func signAWSRequest(req *http.Request, payloadHash string, credentials AWSCredentials, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format(awsDateFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(path, false),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		awsSigningAlgorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func awsCanonicalQuery(query map[string][]string) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent-encodes every byte except the unreserved characters,
+// and slashes unless encodeSlash is set.
+func awsURIEncode(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,133 @@
+package forward
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/timberio/timber-go/metadata"
+)
+
+// The example request from the AWS Signature Version 4 documentation
+func TestSignAWSRequest(test *testing.T) {
+	req, err := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	credentials := AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signAWSRequest(req, sha256Hex(nil), credentials, "us-east-1", "iam", now)
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+
+	if authorization := req.Header.Get("Authorization"); authorization != expected {
+		test.Fatalf("expected %s, got %s", expected, authorization)
+	}
+}
+
+// Instance profile credentials should load from metadata services that
+// require IMDSv2 session tokens
+func TestAWSCredentialsFromEC2(test *testing.T) {
+	expiration := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/latest/api/token" {
+			io.WriteString(w, "session-token")
+			return
+		}
+
+		if r.Header.Get("X-aws-ec2-metadata-token") != "session-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			io.WriteString(w, "logs-role")
+		case "/latest/meta-data/iam/security-credentials/logs-role":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Code":            "Success",
+				"AccessKeyId":     "ASIAEXAMPLE",
+				"SecretAccessKey": "secret",
+				"Token":           "token",
+				"Expiration":      expiration,
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := metadata.NewEC2Client(metadata.DefaultConfig())
+	client.BaseEndpoint = server.URL
+
+	credentials, expires, err := AWSCredentialsFromEC2(client)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	if credentials.AccessKeyID != "ASIAEXAMPLE" || credentials.SessionToken != "token" || !expires.Equal(expiration) {
+		test.Fatalf("unexpected credentials %+v expiring at %s", credentials, expires)
+	}
+}
+
+// Instance profile credentials should be fetched again once they are about to
+// expire
+func TestAWSCredentialsProvider(test *testing.T) {
+	fetches := 0
+	expiration := time.Now().Add(time.Hour)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			io.WriteString(w, "logs-role")
+		case "/latest/meta-data/iam/security-credentials/logs-role":
+			fetches++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Code":            "Success",
+				"AccessKeyId":     "ASIAEXAMPLE",
+				"SecretAccessKey": "secret",
+				"Token":           "token",
+				"Expiration":      expiration,
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := metadata.NewEC2Client(metadata.DefaultConfig())
+	client.BaseEndpoint = server.URL
+
+	provider := newAWSCredentialsProvider(AWSCredentials{}, client)
+
+	for i := 0; i < 2; i++ {
+		if _, err := provider.get(); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	if fetches != 1 {
+		test.Fatalf("expected credentials to be fetched once, got %d fetches", fetches)
+	}
+
+	provider.expiration = time.Now().Add(time.Minute)
+	if _, err := provider.get(); err != nil {
+		test.Fatal(err)
+	}
+
+	if fetches != 2 {
+		test.Fatalf("expected expiring credentials to be fetched again, got %d fetches", fetches)
+	}
+}
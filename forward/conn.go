@@ -0,0 +1,237 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+
+	errConnectionClosed = errors.New("connection closed")
+)
+
+// PartialWriteError reports that only the first Written bytes of a buffer
+// reached the connection before it failed. Forwarders that write lines wrap it
+// in a PartialError holding the lines that were not completely written, so
+// that retrying does not send the others again.
+type PartialWriteError struct {
+	Written int
+	Total   int
+	Err     error
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("wrote %d of %d bytes: %s", e.Written, e.Total, e.Err)
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// frameOffset locates the frame written for a line: its offset in the payload
+// written to the connection and the offset of the line in the buffer.
+type frameOffset struct {
+	payload int
+	line    int
+}
+
+// unwrittenLines turns a *PartialWriteError from writing a payload of frames
+// built from the lines of body into a PartialError holding the lines whose
+// frames were not completely written. A frame cut short is sent again in full.
+// Other errors, and partial writes that did not complete a single frame, are
+// returned unchanged.
+func unwrittenLines(err error, body []byte, frames []frameOffset) error {
+	var partial *PartialWriteError
+	if !errors.As(err, &partial) {
+		return err
+	}
+
+	resend := 0
+	for _, frame := range frames {
+		if frame.payload > partial.Written {
+			break
+		}
+		resend = frame.line
+	}
+
+	if resend == 0 {
+		return err
+	}
+
+	return Partial(body[resend:], err)
+}
+
+// reconnectingConn holds a connection that is dialed on first use and redialed
+// after a failed write. Failed dials are retried with jittered exponential
+// backoff between minBackoff and maxBackoff.
+type reconnectingConn struct {
+	dial func(ctx context.Context) (net.Conn, error)
+
+	// writeTimeout, when set, bounds every write.
+	writeTimeout time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+
+	mutex    sync.Mutex
+	conn     net.Conn
+	failures int
+	nextDial time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newReconnectingConn(dial func(ctx context.Context) (net.Conn, error), writeTimeout, minBackoff, maxBackoff time.Duration) *reconnectingConn {
+	return &reconnectingConn{
+		dial:         dial,
+		writeTimeout: writeTimeout,
+		minBackoff:   minBackoff,
+		maxBackoff:   maxBackoff,
+
+		done: make(chan struct{}),
+	}
+}
+
+// write sends p, dialing first if there is no open connection. If nothing was
+// written because the connection had gone away, it redials and tries once more.
+// A write that fails part way returns a *PartialWriteError, and writing after
+// close fails permanently.
+func (c *reconnectingConn) write(ctx context.Context, p []byte) (int, error) {
+	return c.writeAndRead(ctx, p, nil)
+}
+
+// writeAndRead writes p like write, then, if read is set, calls it with the
+// connection to read a response. The connection is closed if read fails.
+func (c *reconnectingConn) writeAndRead(ctx context.Context, p []byte, read func(conn net.Conn) error) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	reused := c.conn != nil
+
+	n, err := c.writeOnce(ctx, p)
+	if err != nil && n == 0 && reused && ctx.Err() == nil {
+		n, err = c.writeOnce(ctx, p)
+	}
+
+	if err != nil && n > 0 {
+		err = &PartialWriteError{Written: n, Total: len(p), Err: err}
+	}
+
+	if err != nil || read == nil {
+		return n, err
+	}
+
+	if err := read(c.conn); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return n, err
+	}
+
+	return n, nil
+}
+
+func (c *reconnectingConn) writeOnce(ctx context.Context, p []byte) (int, error) {
+	if c.conn == nil {
+		if err := c.connect(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	deadline := time.Time{}
+	if c.writeTimeout > 0 {
+		deadline = time.Now().Add(c.writeTimeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	c.conn.SetWriteDeadline(deadline)
+
+	n, err := c.conn.Write(p)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	return n, err
+}
+
+// connect waits out the backoff left by earlier failures, then dials.
+func (c *reconnectingConn) connect(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return Permanent(errConnectionClosed)
+	default:
+	}
+
+	if wait := time.Until(c.nextDial); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.done:
+			return Permanent(errConnectionClosed)
+		}
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		c.failures++
+		c.nextDial = time.Now().Add(c.backoff())
+		return err
+	}
+
+	c.failures = 0
+	c.nextDial = time.Time{}
+	c.conn = conn
+
+	return nil
+}
+
+// backoff doubles from minBackoff with every consecutive failure, up to
+// maxBackoff, and picks a random duration between half and all of it so that
+// many clients do not reconnect in lockstep.
+func (c *reconnectingConn) backoff() time.Duration {
+	backoff := c.minBackoff
+	for i := 1; i < c.failures && backoff < c.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > c.maxBackoff {
+		backoff = c.maxBackoff
+	}
+
+	if backoff <= 1 {
+		return backoff
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+}
+
+// close closes the connection, interrupting a write that is waiting to
+// reconnect.
+func (c *reconnectingConn) close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	err := c.conn.Close()
+	c.conn = nil
+
+	return err
+}
@@ -0,0 +1,411 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/timberio/timber-go/logging"
+	"github.com/timberio/timber-go/metadata"
+)
+
+var (
+	defaultCloudWatchLogsRegion         = "us-east-1"
+	defaultCloudWatchLogsTimestampField = "dt"
+	defaultCloudWatchLogsMaxRetries     = 5
+	defaultCloudWatchLogsRetryWait      = time.Second
+	defaultCloudWatchLogsTimeout        = 30 * time.Second
+
+	// PutLogEvents limits. Every event counts its message plus 26 bytes
+	// towards the batch size.
+	maxCloudWatchLogsBatchSize   = 1048576
+	maxCloudWatchLogsBatchEvents = 10000
+	maxCloudWatchLogsBatchSpan   = 24 * time.Hour
+	maxCloudWatchLogsEventSize   = 256 * 1024
+	cloudWatchLogsEventOverhead  = 26
+	cloudWatchLogsService        = "logs"
+	cloudWatchLogsTargetPrefix   = "Logs_20140328."
+	cloudWatchLogsContentType    = "application/x-amz-json-1.1"
+)
+
+// CloudWatchLogsForwarder sends every line of a buffer to a CloudWatch Logs
+// log stream with PutLogEvents. The log group and stream are created the
+// first time they are found missing.
+type CloudWatchLogsForwarder struct {
+	HTTPClient *retryablehttp.Client
+	LogGroup   string
+	LogStream  string
+
+	CloudWatchLogsConfig
+
+	credentials *awsCredentialsProvider
+}
+
+type CloudWatchLogsConfig struct {
+	// Region defaults to the AWS_REGION environment variable, then us-east-1.
+	Region string
+	// Endpoint defaults to the CloudWatch Logs endpoint of Region.
+	Endpoint string
+
+	// Credentials sign every request. When empty, they are read from the
+	// environment, and failing that fetched from the instance profile
+	// through EC2Client and refreshed before they expire.
+	Credentials AWSCredentials
+	EC2Client   *metadata.EC2Client
+
+	// TimestampField is the JSON field holding a line's RFC 3339 timestamp,
+	// used as the event timestamp. Lines without one use the time they were
+	// forwarded.
+	TimestampField string
+
+	// MaxRetries is how many times a throttled request is resent, waiting
+	// RetryWait and doubling it after every attempt. Zero disables retries;
+	// DefaultCloudWatchLogsConfig resends it 5 times.
+	MaxRetries int
+	RetryWait  time.Duration
+
+	Logger logging.Logger
+}
+
+func DefaultCloudWatchLogsConfig() CloudWatchLogsConfig {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = defaultCloudWatchLogsRegion
+	}
+
+	return CloudWatchLogsConfig{
+		Region:      region,
+		Credentials: AWSCredentialsFromEnv(),
+
+		TimestampField: defaultCloudWatchLogsTimestampField,
+
+		MaxRetries: defaultCloudWatchLogsMaxRetries,
+		RetryWait:  defaultCloudWatchLogsRetryWait,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+// NewCloudWatchLogsForwarder creates a forwarder for the logStream of
+// logGroup.
+func NewCloudWatchLogsForwarder(logGroup string, logStream string, config CloudWatchLogsConfig) (*CloudWatchLogsForwarder, error) {
+	if logGroup == "" || logStream == "" {
+		return nil, errors.New("CloudWatchLogsForwarder: log group and log stream required")
+	}
+
+	defaultConfig := DefaultCloudWatchLogsConfig()
+
+	if config.Region == "" {
+		config.Region = defaultConfig.Region
+	}
+
+	if config.Endpoint == "" {
+		config.Endpoint = "https://logs." + config.Region + ".amazonaws.com"
+	}
+
+	if config.Credentials.empty() {
+		config.Credentials = defaultConfig.Credentials
+	}
+
+	if config.Credentials.empty() && config.EC2Client == nil {
+		config.EC2Client = metadata.NewEC2Client(metadata.DefaultConfig())
+	}
+
+	if config.TimestampField == "" {
+		config.TimestampField = defaultConfig.TimestampField
+	}
+
+	if config.RetryWait == 0 {
+		config.RetryWait = defaultConfig.RetryWait
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+
+	return &CloudWatchLogsForwarder{
+		HTTPClient:           newRetryableClient(defaultCloudWatchLogsTimeout),
+		LogGroup:             logGroup,
+		LogStream:            logStream,
+		CloudWatchLogsConfig: config,
+
+		credentials: newAWSCredentialsProvider(config.Credentials, config.EC2Client),
+	}, nil
+}
+
+type cloudWatchLogsEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+
+	// The line the event was made from
+	line []byte
+}
+
+// cloudWatchLogsError is an error response of the CloudWatch Logs API.
+type cloudWatchLogsError struct {
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+func (e *cloudWatchLogsError) Error() string {
+	return fmt.Sprintf("CloudWatchLogsForwarder: %s (status code %d): %s", e.Type, e.StatusCode, e.Message)
+}
+
+// Forward sends every line of buffer as an event, sorted by timestamp, in as
+// many PutLogEvents requests as the API limits require. Messages longer than
+// an event allows are truncated.
+//
+// A failure after some batches were accepted returns a PartialError holding
+// the lines of the events that were not, so that retrying does not send
+// duplicates.
+func (c *CloudWatchLogsForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	now := time.Now()
+
+	var events []cloudWatchLogsEvent
+	for _, line := range bytes.Split(buffer.Bytes(), []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		events = append(events, c.event(line, now))
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp < events[j].Timestamp
+	})
+
+	sent := 0
+	for _, batch := range cloudWatchLogsBatches(events) {
+		if err := c.putLogEvents(ctx, batch); err != nil {
+			if sent == 0 {
+				return err
+			}
+
+			var remaining bytes.Buffer
+			for _, event := range events[sent:] {
+				remaining.Write(event.line)
+				remaining.WriteByte('\n')
+			}
+			return Partial(remaining.Bytes(), err)
+		}
+		sent += len(batch)
+	}
+
+	return nil
+}
+
+func (c *CloudWatchLogsForwarder) event(raw []byte, now time.Time) cloudWatchLogsEvent {
+	line := bytes.TrimSpace(raw)
+
+	timestamp := now
+	if value, ok := jsonField(line, []string{c.TimestampField}); ok {
+		if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			timestamp = parsed
+		}
+	}
+
+	if max := maxCloudWatchLogsEventSize - cloudWatchLogsEventOverhead; len(line) > max {
+		// Cut at a character boundary, as messages must be valid UTF-8
+		for max > 0 && !utf8.RuneStart(line[max]) {
+			max--
+		}
+
+		c.Logger.Printf("CloudWatchLogsForwarder: truncating event of %d bytes to %d bytes", len(line), max)
+		line = line[:max]
+	}
+
+	return cloudWatchLogsEvent{
+		Timestamp: timestamp.UnixNano() / int64(time.Millisecond),
+		Message:   string(line),
+
+		line: raw,
+	}
+}
+
+// cloudWatchLogsBatches splits events, sorted by timestamp, into batches
+// within the size, count and time span limits of PutLogEvents.
+func cloudWatchLogsBatches(events []cloudWatchLogsEvent) [][]cloudWatchLogsEvent {
+	var batches [][]cloudWatchLogsEvent
+	start, size := 0, 0
+	span := int64(maxCloudWatchLogsBatchSpan / time.Millisecond)
+
+	for i, event := range events {
+		eventSize := len(event.Message) + cloudWatchLogsEventOverhead
+
+		if i > start && (size+eventSize > maxCloudWatchLogsBatchSize ||
+			i-start == maxCloudWatchLogsBatchEvents ||
+			event.Timestamp-events[start].Timestamp >= span) {
+			batches = append(batches, events[start:i])
+			start, size = i, 0
+		}
+		size += eventSize
+	}
+
+	if start < len(events) {
+		batches = append(batches, events[start:])
+	}
+
+	return batches
+}
+
+// putLogEvents sends a batch, creating the log group and stream if they do
+// not exist and retrying while throttled.
+func (c *CloudWatchLogsForwarder) putLogEvents(ctx context.Context, events []cloudWatchLogsEvent) error {
+	request := map[string]interface{}{
+		"logGroupName":  c.LogGroup,
+		"logStreamName": c.LogStream,
+		"logEvents":     events,
+	}
+
+	var response struct {
+		RejectedLogEventsInfo *struct {
+			TooNewLogEventStartIndex *int `json:"tooNewLogEventStartIndex"`
+			TooOldLogEventEndIndex   *int `json:"tooOldLogEventEndIndex"`
+			ExpiredLogEventEndIndex  *int `json:"expiredLogEventEndIndex"`
+		} `json:"rejectedLogEventsInfo"`
+	}
+
+	created := false
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		err := c.call(ctx, "PutLogEvents", request, &response)
+
+		var apiErr *cloudWatchLogsError
+		switch {
+		case err == nil:
+			if info := response.RejectedLogEventsInfo; info != nil {
+				c.Logger.Printf("CloudWatchLogsForwarder: events rejected: %s", cloudWatchLogsRejected(info.TooNewLogEventStartIndex, info.TooOldLogEventEndIndex, info.ExpiredLogEventEndIndex))
+			}
+			return nil
+		case errors.As(err, &apiErr) && apiErr.Type == "ResourceNotFoundException" && !created:
+			if err := c.createLogStream(ctx); err != nil {
+				return err
+			}
+			created = true
+		case errors.As(err, &apiErr) && apiErr.Type == "ThrottlingException" && attempt < c.MaxRetries:
+			c.Logger.Printf("CloudWatchLogsForwarder: throttled, retrying in %s", wait)
+
+			if err := sleep(ctx, wait); err != nil {
+				return err
+			}
+			wait *= 2
+		default:
+			return err
+		}
+	}
+}
+
+func cloudWatchLogsRejected(tooNewStart *int, tooOldEnd *int, expiredEnd *int) string {
+	var parts []string
+	if tooNewStart != nil {
+		parts = append(parts, fmt.Sprintf("too new from index %d", *tooNewStart))
+	}
+	if tooOldEnd != nil {
+		parts = append(parts, fmt.Sprintf("too old up to index %d", *tooOldEnd))
+	}
+	if expiredEnd != nil {
+		parts = append(parts, fmt.Sprintf("expired up to index %d", *expiredEnd))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// createLogStream creates the log group and log stream, either of which may
+// already exist.
+func (c *CloudWatchLogsForwarder) createLogStream(ctx context.Context) error {
+	c.Logger.Printf("CloudWatchLogsForwarder: creating log stream %s in log group %s", c.LogStream, c.LogGroup)
+
+	err := c.call(ctx, "CreateLogGroup", map[string]string{
+		"logGroupName": c.LogGroup,
+	}, nil)
+	if err != nil && !isCloudWatchLogsError(err, "ResourceAlreadyExistsException") {
+		return err
+	}
+
+	err = c.call(ctx, "CreateLogStream", map[string]string{
+		"logGroupName":  c.LogGroup,
+		"logStreamName": c.LogStream,
+	}, nil)
+	if err != nil && !isCloudWatchLogsError(err, "ResourceAlreadyExistsException") {
+		return err
+	}
+
+	return nil
+}
+
+func isCloudWatchLogsError(err error, errorType string) bool {
+	var apiErr *cloudWatchLogsError
+	return errors.As(err, &apiErr) && apiErr.Type == errorType
+}
+
+// call invokes an API action, decoding the response into response unless it
+// is nil. Error responses other than throttling and server errors are
+// permanent.
+func (c *CloudWatchLogsForwarder) call(ctx context.Context, action string, request interface{}, response interface{}) error {
+	credentials, err := c.credentials.get()
+	if err != nil {
+		return fmt.Errorf("CloudWatchLogsForwarder: %s", err)
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return Permanent(err)
+	}
+
+	req, err := retryablehttp.NewRequest("POST", c.Endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", cloudWatchLogsContentType)
+	req.Header.Set("X-Amz-Target", cloudWatchLogsTargetPrefix+action)
+	signAWSRequest(req.Request, sha256Hex(body), credentials, c.Region, cloudWatchLogsService, time.Now())
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errorResponse struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errorResponse)
+
+		apiErr := &cloudWatchLogsError{
+			StatusCode: resp.StatusCode,
+			// Types may be qualified, e.g. "com.amazonaws.logs#ThrottlingException"
+			Type:    errorResponse.Type[strings.LastIndex(errorResponse.Type, "#")+1:],
+			Message: errorResponse.Message,
+		}
+
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || apiErr.Type == "ThrottlingException" {
+			return apiErr
+		}
+		return Permanent(apiErr)
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("CloudWatchLogsForwarder: could not decode response: %s", err)
+	}
+
+	return nil
+}
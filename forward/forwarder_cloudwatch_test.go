@@ -0,0 +1,247 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timberio/timber-go/logging"
+	"github.com/timberio/timber-go/metadata"
+)
+
+type cloudWatchLogsServer struct {
+	mutex   sync.Mutex
+	actions []string
+	events  []cloudWatchLogsEvent
+	// Errors returned by PutLogEvents, in order, before it succeeds
+	putErrors []string
+	// PutLogEvents requests accepted before putErrors are returned
+	putSuccesses int
+}
+
+func (s *cloudWatchLogsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), cloudWatchLogsTargetPrefix)
+	s.actions = append(s.actions, action)
+
+	if r.Header.Get("Content-Type") != cloudWatchLogsContentType ||
+		!strings.Contains(r.Header.Get("Authorization"), "/logs/aws4_request") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if action == "PutLogEvents" && s.putSuccesses > 0 {
+		s.putSuccesses--
+	} else if action == "PutLogEvents" && len(s.putErrors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"__type":"com.amazonaws.logs#`+s.putErrors[0]+`","message":"failed"}`)
+		s.putErrors = s.putErrors[1:]
+		return
+	}
+
+	if action == "PutLogEvents" {
+		var request struct {
+			LogEvents []cloudWatchLogsEvent `json:"logEvents"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		s.events = append(s.events, request.LogEvents...)
+	}
+
+	io.WriteString(w, `{}`)
+}
+
+// Missing log groups and streams should be created, and events sent in
+// chronological order
+func TestCloudWatchLogsForwarderCreate(test *testing.T) {
+	server := &cloudWatchLogsServer{putErrors: []string{"ResourceNotFoundException"}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	forwarder, err := NewCloudWatchLogsForwarder("app", "web-1", CloudWatchLogsConfig{
+		Endpoint:    ts.URL,
+		Credentials: testAWSCredentials,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	buffer := bytes.NewBufferString(`{"dt":"2019-01-01T00:00:02Z","message":"second"}
+{"dt":"2019-01-01T00:00:01Z","message":"first"}
+`)
+
+	if err := forwarder.Forward(context.Background(), buffer); err != nil {
+		test.Fatal(err)
+	}
+
+	actions := strings.Join(server.actions, ",")
+	if actions != "PutLogEvents,CreateLogGroup,CreateLogStream,PutLogEvents" {
+		test.Fatalf("unexpected actions %s", actions)
+	}
+
+	if len(server.events) != 2 || server.events[0].Timestamp != 1546300801000 {
+		test.Fatalf("expected events sorted by timestamp, got %+v", server.events)
+	}
+}
+
+// Throttled requests should be retried, and reported as retryable once
+// retries are exhausted
+func TestCloudWatchLogsForwarderThrottling(test *testing.T) {
+	server := &cloudWatchLogsServer{putErrors: []string{"ThrottlingException", "ThrottlingException", "ThrottlingException"}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	forwarder, err := NewCloudWatchLogsForwarder("app", "web-1", CloudWatchLogsConfig{
+		Endpoint:    ts.URL,
+		Credentials: testAWSCredentials,
+		MaxRetries:  1,
+		RetryWait:   time.Millisecond,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	err = forwarder.Forward(context.Background(), bytes.NewBufferString("message\n"))
+	if err == nil || IsPermanent(err) {
+		test.Fatalf("expected a retryable error, got %v", err)
+	}
+
+	if err := forwarder.Forward(context.Background(), bytes.NewBufferString("message\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	if len(server.events) != 1 {
+		test.Fatalf("expected 1 event, got %d", len(server.events))
+	}
+}
+
+// Batches should respect the event count, size and time span limits
+// When a later batch fails, only the lines of the batches that were not sent
+// should be left for a retry, and a zero MaxRetries should not retry
+func TestCloudWatchLogsForwarderPartial(test *testing.T) {
+	server := &cloudWatchLogsServer{
+		putErrors:    []string{"ThrottlingException", "ThrottlingException"},
+		putSuccesses: 1,
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	forwarder, err := NewCloudWatchLogsForwarder("app", "web-1", CloudWatchLogsConfig{
+		Endpoint:    ts.URL,
+		Credentials: testAWSCredentials,
+		MaxRetries:  0,
+		Logger:      logging.DiscardingLogger,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// More than a day apart, so sent in separate batches
+	later := `{"dt":"2019-01-03T00:00:00Z","message":"later"}`
+	buffer := bytes.NewBufferString(later + "\n" + `{"dt":"2019-01-01T00:00:00Z","message":"earlier"}` + "\n")
+
+	err = forwarder.Forward(context.Background(), buffer)
+	if err == nil || IsPermanent(err) || Remaining(buffer, err).String() != later+"\n" {
+		test.Fatalf("expected the later line to remain, got %v", err)
+	}
+
+	if len(server.actions) != 2 {
+		test.Fatalf("expected no retries, got actions %v", server.actions)
+	}
+}
+
+func TestCloudWatchLogsBatches(test *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+
+	events := make([]cloudWatchLogsEvent, maxCloudWatchLogsBatchEvents+1)
+	for i := range events {
+		events[i] = cloudWatchLogsEvent{Timestamp: start, Message: "message"}
+	}
+
+	if batches := cloudWatchLogsBatches(events); len(batches) != 2 || len(batches[0]) != maxCloudWatchLogsBatchEvents {
+		test.Fatalf("expected a batch of %d events and another, got %d batches", maxCloudWatchLogsBatchEvents, len(batches))
+	}
+
+	large := strings.Repeat("x", maxCloudWatchLogsEventSize-cloudWatchLogsEventOverhead)
+	events = []cloudWatchLogsEvent{
+		{Timestamp: start, Message: large},
+		{Timestamp: start, Message: large},
+		{Timestamp: start, Message: large},
+		{Timestamp: start, Message: large},
+		{Timestamp: start, Message: large},
+	}
+
+	if batches := cloudWatchLogsBatches(events); len(batches) != 2 || len(batches[0]) != 4 {
+		test.Fatalf("expected batches of 4 and 1 events, got %d batches", len(batches))
+	}
+
+	day := int64(24 * time.Hour / time.Millisecond)
+	events = []cloudWatchLogsEvent{
+		{Timestamp: start, Message: "first"},
+		{Timestamp: start + day - 1, Message: "second"},
+		{Timestamp: start + day, Message: "third"},
+	}
+
+	if batches := cloudWatchLogsBatches(events); len(batches) != 2 || len(batches[0]) != 2 {
+		test.Fatalf("expected batches of 2 and 1 events, got %d batches", len(batches))
+	}
+}
+
+// Without configured credentials, the instance profile should be used
+func TestCloudWatchLogsForwarderInstanceProfile(test *testing.T) {
+	metadataServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			io.WriteString(w, "logs-role")
+		case "/latest/meta-data/iam/security-credentials/logs-role":
+			json.NewEncoder(w).Encode(map[string]string{
+				"Code":            "Success",
+				"AccessKeyId":     "ASIAEXAMPLE",
+				"SecretAccessKey": "secret",
+				"Token":           "token",
+				"Expiration":      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer metadataServer.Close()
+
+	var authorization, token string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		token = r.Header.Get("X-Amz-Security-Token")
+		io.WriteString(w, `{}`)
+	}))
+	defer ts.Close()
+
+	ec2Client := metadata.NewEC2Client(metadata.DefaultConfig())
+	ec2Client.BaseEndpoint = metadataServer.URL
+
+	forwarder, err := NewCloudWatchLogsForwarder("app", "web-1", CloudWatchLogsConfig{
+		Endpoint:  ts.URL,
+		EC2Client: ec2Client,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	// Ignore credentials in the environment
+	forwarder.Credentials = AWSCredentials{}
+	forwarder.credentials = newAWSCredentialsProvider(AWSCredentials{}, ec2Client)
+
+	if err := forwarder.Forward(context.Background(), bytes.NewBufferString("message\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	if !strings.Contains(authorization, "Credential=ASIAEXAMPLE/") || token != "token" {
+		test.Fatalf("expected instance profile credentials, got %q with token %q", authorization, token)
+	}
+}
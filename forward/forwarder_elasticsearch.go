@@ -0,0 +1,392 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/timberio/timber-go/compress"
+	"github.com/timberio/timber-go/logging"
+)
+
+var (
+	defaultElasticsearchIndex          = "logs-{2006.01.02}"
+	defaultElasticsearchOpType         = "index"
+	defaultElasticsearchTimestampField = "dt"
+	// Matches the default buffer size of the batch package, so that a full
+	// batch fits in a single bulk request.
+	defaultElasticsearchMaxBulkSize = 990000
+	defaultElasticsearchMaxRetries  = 3
+	defaultElasticsearchRetryWait   = time.Second
+	defaultElasticsearchTimeout     = 30 * time.Second
+
+	// Time layouts in braces, e.g. {2006.01.02}
+	indexTemplateLayout = regexp.MustCompile(`\{([^}]*)\}`)
+)
+
+// ElasticsearchForwarder indexes every JSON line of a buffer as a document
+// through the Elasticsearch or OpenSearch _bulk API. Documents rejected with a
+// retryable status are resent on their own, without resending the documents
+// that were accepted.
+type ElasticsearchForwarder struct {
+	HTTPClient *retryablehttp.Client
+	Endpoint   string
+
+	ElasticsearchConfig
+}
+
+type ElasticsearchConfig struct {
+	// Index names the index of each document. Go time layouts in braces are
+	// replaced with the document's UTC timestamp, e.g. "logs-{2006.01.02}".
+	Index string
+	// OpType is the bulk action, "index" or "create". Data streams require
+	// "create".
+	OpType string
+	// TimestampField is the JSON field holding a document's RFC 3339
+	// timestamp, used for the index name. Documents without one use the time
+	// they were forwarded.
+	TimestampField string
+
+	// Username and Password set basic authentication. APIKey, when set, is
+	// sent as an ApiKey authorization instead.
+	Username string
+	Password string
+	APIKey   string
+
+	// MaxBulkSize bounds the size of each bulk request body before
+	// compression. Larger buffers are sent in several requests.
+	MaxBulkSize int
+	// MaxRetries is how many times documents rejected with a retryable status
+	// are resent, waiting RetryWait and doubling it after every attempt. Zero
+	// disables retries; DefaultElasticsearchConfig resends them 3 times.
+	MaxRetries int
+	RetryWait  time.Duration
+
+	Compression compress.Codec
+
+	Logger logging.Logger
+}
+
+func DefaultElasticsearchConfig() ElasticsearchConfig {
+	return ElasticsearchConfig{
+		Index:          defaultElasticsearchIndex,
+		OpType:         defaultElasticsearchOpType,
+		TimestampField: defaultElasticsearchTimestampField,
+
+		MaxBulkSize: defaultElasticsearchMaxBulkSize,
+		MaxRetries:  defaultElasticsearchMaxRetries,
+		RetryWait:   defaultElasticsearchRetryWait,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+// NewElasticsearchForwarder creates a forwarder for the cluster at endpoint,
+// e.g. "https://localhost:9200".
+func NewElasticsearchForwarder(endpoint string, config ElasticsearchConfig) (*ElasticsearchForwarder, error) {
+	if endpoint == "" {
+		return nil, errors.New("ElasticsearchForwarder: endpoint required")
+	}
+
+	defaultConfig := DefaultElasticsearchConfig()
+
+	if config.Index == "" {
+		config.Index = defaultConfig.Index
+	}
+
+	if config.OpType == "" {
+		config.OpType = defaultConfig.OpType
+	}
+
+	if config.OpType != "index" && config.OpType != "create" {
+		return nil, fmt.Errorf("ElasticsearchForwarder: unsupported op type %q", config.OpType)
+	}
+
+	if config.TimestampField == "" {
+		config.TimestampField = defaultConfig.TimestampField
+	}
+
+	if config.MaxBulkSize == 0 {
+		config.MaxBulkSize = defaultConfig.MaxBulkSize
+	}
+
+	if config.RetryWait == 0 {
+		config.RetryWait = defaultConfig.RetryWait
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	return &ElasticsearchForwarder{
+		HTTPClient:          newRetryableClient(defaultElasticsearchTimeout),
+		Endpoint:            strings.TrimSuffix(endpoint, "/"),
+		ElasticsearchConfig: config,
+	}, nil
+}
+
+// bulkItem is an action line and document line, each ending in a newline,
+// built from line.
+type bulkItem struct {
+	body []byte
+	line []byte
+}
+
+// Forward indexes every line of buffer, in as many bulk requests as
+// MaxBulkSize requires. Lines that are not JSON objects are indexed as
+// {"message": line}.
+//
+// Documents that still fail with a retryable status after MaxRetries make the
+// failure retryable. Once other documents were indexed or rejected, it is a
+// PartialError holding only their lines, so that retrying does not index
+// duplicates. Otherwise the failure is permanent.
+func (e *ElasticsearchForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	now := time.Now()
+
+	var pending []bulkItem
+	var total, indexed, rejected int
+	var rejectedErr, retryErr error
+
+	for _, line := range bytes.Split(buffer.Bytes(), []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		total++
+
+		item := e.item(line, now)
+		if len(item.body) > e.MaxBulkSize {
+			rejected++
+			rejectedErr = fmt.Errorf("document of %d bytes exceeds the bulk size of %d bytes", len(item.body), e.MaxBulkSize)
+			continue
+		}
+
+		pending = append(pending, item)
+	}
+
+	wait := e.RetryWait
+	for attempt := 0; len(pending) > 0 && attempt <= e.MaxRetries; attempt++ {
+		if attempt > 0 {
+			e.Logger.Printf("ElasticsearchForwarder: retrying %d documents in %s: %s", len(pending), wait, retryErr)
+
+			if err := sleep(ctx, wait); err != nil {
+				retryErr = err
+				break
+			}
+			wait *= 2
+		}
+
+		var retry []bulkItem
+		for _, chunk := range e.chunks(pending) {
+			errs, err := e.bulk(ctx, chunk)
+
+			for i, item := range chunk {
+				itemErr := err
+				if errs != nil {
+					itemErr = errs[i]
+				}
+
+				switch {
+				case itemErr == nil:
+					indexed++
+				case IsPermanent(itemErr):
+					rejected++
+					rejectedErr = itemErr
+				default:
+					retry = append(retry, item)
+					retryErr = itemErr
+				}
+			}
+		}
+
+		pending = retry
+	}
+
+	if len(pending) == 0 && rejected == 0 {
+		return nil
+	}
+
+	cause := rejectedErr
+	if len(pending) > 0 {
+		cause = retryErr
+	}
+
+	err := fmt.Errorf("ElasticsearchForwarder: %d of %d documents failed: %s", len(pending)+rejected, total, cause)
+	if len(pending) == 0 {
+		return Permanent(err)
+	}
+
+	if indexed == 0 && rejected == 0 {
+		return err
+	}
+
+	var remaining bytes.Buffer
+	for _, item := range pending {
+		remaining.Write(item.line)
+		remaining.WriteByte('\n')
+	}
+
+	return Partial(remaining.Bytes(), err)
+}
+
+// item builds the bulk action and document for a line.
+func (e *ElasticsearchForwarder) item(line []byte, now time.Time) bulkItem {
+	line = bytes.TrimSpace(line)
+
+	document := line
+	if len(line) == 0 || line[0] != '{' || !json.Valid(line) {
+		document, _ = json.Marshal(map[string]string{"message": string(line)})
+	}
+
+	timestamp := now
+	if value, ok := jsonField(document, []string{e.TimestampField}); ok {
+		if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			timestamp = parsed
+		}
+	}
+
+	action, _ := json.Marshal(map[string]map[string]string{
+		e.OpType: {"_index": e.indexName(timestamp)},
+	})
+
+	body := make([]byte, 0, len(action)+len(document)+2)
+	body = append(body, action...)
+	body = append(body, '\n')
+	body = append(body, document...)
+	body = append(body, '\n')
+
+	return bulkItem{body: body, line: line}
+}
+
+func (e *ElasticsearchForwarder) indexName(timestamp time.Time) string {
+	timestamp = timestamp.UTC()
+
+	return indexTemplateLayout.ReplaceAllStringFunc(e.Index, func(match string) string {
+		return timestamp.Format(match[1 : len(match)-1])
+	})
+}
+
+// chunks groups items into request bodies of at most MaxBulkSize bytes.
+func (e *ElasticsearchForwarder) chunks(items []bulkItem) [][]bulkItem {
+	var chunks [][]bulkItem
+	start, size := 0, 0
+
+	for i, item := range items {
+		if size+len(item.body) > e.MaxBulkSize && i > start {
+			chunks = append(chunks, items[start:i])
+			start, size = i, 0
+		}
+		size += len(item.body)
+	}
+
+	if start < len(items) {
+		chunks = append(chunks, items[start:])
+	}
+
+	return chunks
+}
+
+type bulkResponse struct {
+	Errors bool                             `json:"errors"`
+	Items  []map[string]bulkResponseOutcome `json:"items"`
+}
+
+type bulkResponseOutcome struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// bulk sends a single bulk request. It returns the outcome of every item, or
+// an error if the request as a whole failed.
+func (e *ElasticsearchForwarder) bulk(ctx context.Context, items []bulkItem) ([]error, error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		body.Write(item.body)
+	}
+
+	payload := body.Bytes()
+	if e.Compression != nil {
+		var compressed bytes.Buffer
+		if err := compress.Encode(e.Compression, &compressed, payload); err != nil {
+			return nil, Permanent(err)
+		}
+		payload = compressed.Bytes()
+	}
+
+	req, err := retryablehttp.NewRequest("POST", e.Endpoint+"/_bulk", bytes.NewReader(payload))
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	if e.Compression != nil {
+		req.Header.Add("Content-Encoding", e.Compression.Encoding())
+	}
+
+	if e.APIKey != "" {
+		req.Header.Add("Authorization", "ApiKey "+e.APIKey)
+	} else if e.Username != "" {
+		req.SetBasicAuth(e.Username, e.Password)
+	}
+
+	resp, err := e.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return nil, statusError("ElasticsearchForwarder", resp)
+	}
+
+	var response bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("ElasticsearchForwarder: could not decode bulk response: %s", err)
+	}
+
+	errs := make([]error, len(items))
+	if !response.Errors {
+		return errs, nil
+	}
+
+	if len(response.Items) != len(items) {
+		return nil, fmt.Errorf("ElasticsearchForwarder: bulk response has %d items, expected %d", len(response.Items), len(items))
+	}
+
+	for i, outcomes := range response.Items {
+		for _, outcome := range outcomes {
+			if outcome.Status < 300 {
+				continue
+			}
+
+			err := fmt.Errorf("status %d: %s", outcome.Status, outcome.Error)
+			if outcome.Status == http.StatusTooManyRequests || outcome.Status >= 500 {
+				errs[i] = err
+			} else {
+				errs[i] = Permanent(err)
+			}
+		}
+	}
+
+	return errs, nil
+}
+
+// sleep waits for d, returning early with ctx.Err() if ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
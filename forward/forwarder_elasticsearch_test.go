@@ -0,0 +1,156 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Only documents rejected with a retryable status should be resent
+func TestElasticsearchForwarderRetriesFailedItems(test *testing.T) {
+	var mutex sync.Mutex
+	var requests [][]string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var lines []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+
+		mutex.Lock()
+		requests = append(requests, lines)
+		first := len(requests) == 1
+		mutex.Unlock()
+
+		if !first {
+			fmt.Fprint(w, `{"errors":false,"items":[{"index":{"status":201}}]}`)
+			return
+		}
+
+		fmt.Fprint(w, `{"errors":true,"items":[
+			{"index":{"status":201}},
+			{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},
+			{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}
+		]}`)
+	}))
+	defer server.Close()
+
+	forwarder, err := NewElasticsearchForwarder(server.URL, ElasticsearchConfig{
+		MaxRetries: 3,
+		RetryWait:  time.Millisecond,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	buffer := bytes.NewBufferString(`{"dt":"2019-03-04T05:06:07Z","message":"one"}
+{"message":"two"}
+plain three
+`)
+
+	err = forwarder.Forward(context.Background(), buffer)
+	if err == nil || !IsPermanent(err) || !strings.Contains(err.Error(), "1 of 3 documents failed") {
+		test.Fatalf("expected a permanent failure for the rejected document, got %v", err)
+	}
+
+	if len(requests) != 2 {
+		test.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+
+	if requests[0][0] != `{"index":{"_index":"logs-2019.03.04"}}` {
+		test.Fatalf("expected the index to be named after dt, got %s", requests[0][0])
+	}
+
+	var wrapped map[string]string
+	if err := json.Unmarshal([]byte(requests[0][5]), &wrapped); err != nil || wrapped["message"] != "plain three" {
+		test.Fatalf("expected plain lines to be wrapped in a document, got %s", requests[0][5])
+	}
+
+	if len(requests[1]) != 2 || requests[1][1] != `{"message":"two"}` {
+		test.Fatalf("expected only the throttled document to be resent, got %v", requests[1])
+	}
+}
+
+// With retries disabled, only the throttled document's line should be left
+// for a retry
+func TestElasticsearchForwarderPartial(test *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `{"errors":true,"items":[
+			{"index":{"status":201}},
+			{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}}
+		]}`)
+	}))
+	defer server.Close()
+
+	forwarder, err := NewElasticsearchForwarder(server.URL, ElasticsearchConfig{})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	buffer := bytes.NewBufferString("{\"message\":\"one\"}\n{\"message\":\"two\"}\n")
+	err = forwarder.Forward(context.Background(), buffer)
+
+	if err == nil || IsPermanent(err) || Remaining(buffer, err).String() != "{\"message\":\"two\"}\n" {
+		test.Fatalf("expected a retryable error for the second document, got %v", err)
+	}
+
+	if requests != 1 {
+		test.Fatalf("expected no retries, got %d requests", requests)
+	}
+}
+
+// Buffers larger than MaxBulkSize should be split across requests
+func TestElasticsearchForwarderMaxBulkSize(test *testing.T) {
+	var mutex sync.Mutex
+	var sizes []int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+
+		mutex.Lock()
+		sizes = append(sizes, body.Len())
+		mutex.Unlock()
+
+		fmt.Fprint(w, `{"errors":false,"items":[]}`)
+	}))
+	defer server.Close()
+
+	forwarder, err := NewElasticsearchForwarder(server.URL, ElasticsearchConfig{
+		Index:       "logs",
+		MaxBulkSize: 200,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&buffer, "{\"message\":\"line %d\"}\n", i)
+	}
+
+	if err := forwarder.Forward(context.Background(), &buffer); err != nil {
+		test.Fatal(err)
+	}
+
+	if len(sizes) < 2 {
+		test.Fatalf("expected several requests, got %d", len(sizes))
+	}
+
+	for _, size := range sizes {
+		if size > 200 {
+			test.Fatalf("expected requests of at most 200 bytes, got %d", size)
+		}
+	}
+}
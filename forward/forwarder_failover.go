@@ -0,0 +1,171 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/timberio/timber-go/logging"
+)
+
+var (
+	defaultFailoverFailureThreshold = 3
+	defaultFailoverCooldown         = 30 * time.Second
+
+	// ErrNoHealthyDestination is returned when every destination's circuit
+	// breaker is open.
+	ErrNoHealthyDestination = errors.New("FailoverForwarder: no healthy destination")
+)
+
+// FailoverForwarder sends every buffer to the first healthy destination in
+// order, falling back to the next one when it fails. The first destination is
+// the primary; since destinations are always tried in order, buffers return
+// to the primary as soon as its circuit breaker lets a trial call succeed.
+type FailoverForwarder struct {
+	Destinations []Destination
+
+	FailoverConfig
+
+	breakers []*CircuitBreaker
+}
+
+type FailoverConfig struct {
+	// FailureThreshold is the number of consecutive failures after which a
+	// destination is skipped.
+	FailureThreshold int
+	// Cooldown is how long an unhealthy destination is skipped before it is
+	// tried again.
+	Cooldown time.Duration
+
+	Logger logging.Logger
+}
+
+// DestinationHealth is the circuit breaker state of a destination.
+type DestinationHealth struct {
+	Destination string
+	State       BreakerState
+}
+
+func DefaultFailoverConfig() FailoverConfig {
+	return FailoverConfig{
+		FailureThreshold: defaultFailoverFailureThreshold,
+		Cooldown:         defaultFailoverCooldown,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+func NewFailoverForwarder(destinations []Destination, config FailoverConfig) *FailoverForwarder {
+	defaultConfig := DefaultFailoverConfig()
+
+	if config.FailureThreshold == 0 {
+		config.FailureThreshold = defaultConfig.FailureThreshold
+	}
+
+	if config.Cooldown == 0 {
+		config.Cooldown = defaultConfig.Cooldown
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	breakers := make([]*CircuitBreaker, len(destinations))
+	for i := range destinations {
+		breakers[i] = NewCircuitBreaker(config.FailureThreshold, config.Cooldown)
+	}
+
+	return &FailoverForwarder{
+		Destinations:   destinations,
+		FailoverConfig: config,
+
+		breakers: breakers,
+	}
+}
+
+// Forward returns nil as soon as one destination accepts the buffer. A
+// destination that delivers only part of it passes the remaining lines on to
+// the next. If every destination fails, the error is permanent only if every
+// failure was. Permanent failures reject the buffer rather than the
+// destination, so they do not count towards its circuit breaker.
+func (f *FailoverForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	var errs []string
+	permanent := true
+	partial := false
+
+	for i, destination := range f.Destinations {
+		breaker := f.breakers[i]
+		if !breaker.Allow() {
+			continue
+		}
+
+		err := destination.Forwarder.Forward(ctx, buffer)
+		if err == nil {
+			if breaker.State() != BreakerClosed {
+				f.Logger.Printf("FailoverForwarder: %s has recovered", destination.Name)
+			}
+			breaker.Success()
+
+			if i > 0 {
+				f.Logger.Printf("FailoverForwarder: delivered buffer to fallback destination %s", destination.Name)
+			}
+			return nil
+		}
+
+		if !IsPermanent(err) {
+			wasOpen := breaker.State() == BreakerOpen
+			breaker.Failure()
+			if !wasOpen && breaker.State() == BreakerOpen {
+				f.Logger.Printf("FailoverForwarder: %s is unhealthy, skipping it for %s: %s", destination.Name, f.Cooldown, err)
+			}
+		}
+
+		errs = append(errs, fmt.Sprintf("%s: %s", destination.Name, err))
+		permanent = permanent && IsPermanent(err)
+
+		if remaining := Remaining(buffer, err); remaining != buffer {
+			buffer = remaining
+			partial = true
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(errs) == 0 {
+		return ErrNoHealthyDestination
+	}
+
+	err := fmt.Errorf("FailoverForwarder: every destination failed: %s", strings.Join(errs, "; "))
+	if permanent {
+		err = Permanent(err)
+	}
+
+	if partial {
+		return Partial(buffer.Bytes(), err)
+	}
+
+	return err
+}
+
+// Health returns the circuit breaker state of every destination.
+func (f *FailoverForwarder) Health() []DestinationHealth {
+	health := make([]DestinationHealth, len(f.Destinations))
+	for i, destination := range f.Destinations {
+		health[i] = DestinationHealth{
+			Destination: destination.Name,
+			State:       f.breakers[i].State(),
+		}
+	}
+
+	return health
+}
+
+// Close closes every destination that implements Closer.
+func (f *FailoverForwarder) Close(ctx context.Context) error {
+	return closeDestinations(ctx, "FailoverForwarder", f.Destinations)
+}
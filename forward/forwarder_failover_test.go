@@ -0,0 +1,113 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type toggleForwarder struct {
+	failing   bool
+	forwarded int
+}
+
+func (t *toggleForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	if t.failing {
+		return errors.New("endpoint is down")
+	}
+	t.forwarded++
+	return nil
+}
+
+// Buffers should fall back to the secondary while the primary is unhealthy and
+// return to the primary once it recovers
+func TestFailoverForwarder(test *testing.T) {
+	primary := &toggleForwarder{failing: true}
+	secondary := &toggleForwarder{}
+
+	failover := NewFailoverForwarder([]Destination{
+		{Name: "primary", Forwarder: primary},
+		{Name: "secondary", Forwarder: secondary},
+	}, FailoverConfig{
+		FailureThreshold: 2,
+		Cooldown:         20 * time.Millisecond,
+	})
+
+	for i := 0; i < 4; i++ {
+		if err := failover.Forward(context.Background(), bytes.NewBufferString("test log line\n")); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	if secondary.forwarded != 4 {
+		test.Fatalf("expected 4 buffers on the secondary, got %d", secondary.forwarded)
+	}
+
+	if health := failover.Health(); health[0].State != BreakerOpen || health[1].State != BreakerClosed {
+		test.Fatalf("expected the primary to be open and the secondary closed, got %+v", health)
+	}
+
+	primary.failing = false
+	time.Sleep(30 * time.Millisecond)
+
+	failover.Forward(context.Background(), bytes.NewBufferString("test log line\n"))
+
+	if primary.forwarded != 1 || failover.Health()[0].State != BreakerClosed {
+		test.Fatalf("expected the primary to recover, got %d buffers and state %s", primary.forwarded, failover.Health()[0].State)
+	}
+}
+
+// A failure in every destination should be returned
+func TestFailoverForwarderAllFailing(test *testing.T) {
+	failover := NewFailoverForwarder([]Destination{
+		{Name: "primary", Forwarder: &toggleForwarder{failing: true}},
+		{Name: "secondary", Forwarder: ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+			return Permanent(errors.New("rejected"))
+		})},
+	}, FailoverConfig{
+		FailureThreshold: 1,
+		Cooldown:         time.Hour,
+	})
+
+	err := failover.Forward(context.Background(), bytes.NewBufferString("test log line\n"))
+	if err == nil || IsPermanent(err) {
+		test.Fatalf("expected a retryable error, got %v", err)
+	}
+
+	// Permanent failures reject the buffer, not the destination
+	if health := failover.Health(); health[0].State != BreakerOpen || health[1].State != BreakerClosed {
+		test.Fatalf("expected only the primary to be open, got %+v", health)
+	}
+
+	if err := failover.Forward(context.Background(), bytes.NewBufferString("test log line\n")); !IsPermanent(err) {
+		test.Fatalf("expected a permanent error from the secondary, got %v", err)
+	}
+}
+
+// When the primary fails part way, only the remaining lines should be sent to
+// the secondary
+func TestFailoverForwarderPartial(test *testing.T) {
+	var received string
+	failover := NewFailoverForwarder([]Destination{
+		{Name: "primary", Forwarder: ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+			return Partial([]byte("second\n"), errors.New("endpoint is down"))
+		})},
+		{Name: "secondary", Forwarder: ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+			received = buffer.String()
+			return errors.New("endpoint is down")
+		})},
+	}, FailoverConfig{})
+
+	buffer := bytes.NewBufferString("first\nsecond\n")
+	err := failover.Forward(context.Background(), buffer)
+
+	if received != "second\n" {
+		test.Fatalf("expected only the remaining line on the secondary, got \"%s\"", received)
+	}
+
+	if IsPermanent(err) || Remaining(buffer, err).String() != "second\n" {
+		test.Fatalf("expected a retryable error for the remaining line, got %v", err)
+	}
+}
@@ -3,71 +3,423 @@ package forward
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/timberio/timber-go/compress"
 	"github.com/timberio/timber-go/logging"
 )
 
+var (
+	// Suffix appended to rotated files, ordered by the time they were rotated
+	rotatedTimeFormat = "20060102T150405.000000000"
+
+	defaultFileSyncInterval = time.Second
+
+	errFileForwarderClosed = errors.New("FileForwarder: closed")
+)
+
+// SyncMode decides when written data is flushed to stable storage.
+type SyncMode int
+
+const (
+	// SyncNone leaves flushing to the operating system.
+	SyncNone SyncMode = iota
+	// SyncBatch syncs the file after every buffer is written.
+	SyncBatch
+	// SyncPeriodic syncs the file every SyncInterval if it has been written to.
+	SyncPeriodic
+)
+
 type FileForwarder struct {
 	Filename string
-	Logger   logging.Logger
 
-	file *os.File
+	FileConfig
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	dirty  bool
+	closed bool
+
+	// Serializes compressing and pruning rotated files
+	backupMutex sync.Mutex
+
+	signals chan os.Signal
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type FileConfig struct {
+	// MaxSize, when set, rotates the file before a write would grow it
+	// beyond this many bytes.
+	MaxSize int64
+	// RotateInterval, when set, rotates the file once it has been written to
+	// for this long.
+	RotateInterval time.Duration
+	// MaxBackups is the number of rotated files to keep. Zero keeps them all.
+	MaxBackups int
+	// Compress gzips rotated files.
+	Compress bool
+	// ReopenOnSIGHUP reopens Filename when the process receives SIGHUP, so
+	// that external tools such as logrotate can move the file aside.
+	ReopenOnSIGHUP bool
+
+	// Sync decides how often written buffers are synced to disk.
+	Sync SyncMode
+	// SyncInterval is how often the file is synced with SyncPeriodic.
+	SyncInterval time.Duration
+
+	Logger logging.Logger
+}
+
+func DefaultFileConfig() FileConfig {
+	return FileConfig{
+		SyncInterval: defaultFileSyncInterval,
+
+		Logger: logging.DefaultLogger,
+	}
 }
 
 func NewFileForwarder(filename string, logger logging.Logger) (*FileForwarder, error) {
-	if logger == nil {
-		logger = logging.DefaultLogger
+	return NewFileForwarderWithConfig(filename, FileConfig{
+		Logger: logger,
+	})
+}
+
+func NewFileForwarderWithConfig(filename string, config FileConfig) (*FileForwarder, error) {
+	defaultConfig := DefaultFileConfig()
+
+	if config.SyncInterval == 0 {
+		config.SyncInterval = defaultConfig.SyncInterval
 	}
 
-	file, err := openFile(filename)
-	if err != nil {
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	f := &FileForwarder{
+		Filename:   filename,
+		FileConfig: config,
+
+		stop: make(chan struct{}),
+	}
+
+	if err := f.open(); err != nil {
 		return nil, err
 	}
 
-	return &FileForwarder{
-		Filename: filename,
+	if config.ReopenOnSIGHUP {
+		f.signals = make(chan os.Signal, 1)
+		signal.Notify(f.signals, syscall.SIGHUP)
+
+		f.wg.Add(1)
+		go f.reopenOnSignal()
+	}
+
+	if config.Sync == SyncPeriodic {
+		f.wg.Add(1)
+		go f.syncPeriodically()
+	}
 
-		file: file,
-	}, nil
+	return f, nil
 }
 
+// openFile opens filename for appending, creating it if needed. Every write
+// lands at the end of the file, even when other processes append to it too.
 func openFile(filename string) (*os.File, error) {
 	err := os.MkdirAll(filepath.Dir(filename), os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
 
-	var file *os.File
+	return os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
 
-	if _, err := os.Stat(filename); err == nil {
-		file, err = os.OpenFile(filename, os.O_RDWR, os.ModePerm)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		file, err = os.Create(filename)
-		if err != nil {
-			return nil, err
+func (f *FileForwarder) reopenOnSignal() {
+	defer f.wg.Done()
+
+	for {
+		select {
+		case <-f.signals:
+			if err := f.Reopen(); err != nil {
+				f.Logger.Printf("FileForwarder: could not reopen %s: %s", f.Filename, err)
+			}
+		case <-f.stop:
+			return
 		}
 	}
+}
+
+func (f *FileForwarder) syncPeriodically() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(f.SyncInterval)
+	defer ticker.Stop()
 
-	return file, nil
+	for {
+		select {
+		case <-ticker.C:
+			f.mutex.Lock()
+			if f.dirty && !f.closed && f.file != nil {
+				if err := f.file.Sync(); err != nil {
+					f.Logger.Printf("FileForwarder: could not sync %s: %s", f.Filename, err)
+				}
+				f.dirty = false
+			}
+			f.mutex.Unlock()
+		case <-f.stop:
+			return
+		}
+	}
 }
 
-func (f *FileForwarder) Forward(buffer *bytes.Buffer) {
-	writer := bufio.NewWriter(f.file)
+// open opens Filename, recording its size for rotation. The caller must hold
+// f.mutex once the forwarder is in use.
+func (f *FileForwarder) open() error {
+	file, err := openFile(f.Filename)
+	if err != nil {
+		return err
+	}
 
-	_, err := writer.Write(buffer.Bytes())
+	info, err := file.Stat()
 	if err != nil {
-		f.Logger.Print(err)
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+
+	return nil
+}
+
+// Reopen closes and reopens Filename, picking up a new file if the current
+// one has been moved or removed.
+func (f *FileForwarder) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return errFileForwarderClosed
+	}
+
+	f.closeFile()
+	return f.open()
+}
+
+// Rotate moves the current file aside and starts a new one.
+func (f *FileForwarder) Rotate() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return errFileForwarderClosed
+	}
+
+	return f.rotate()
+}
+
+// Close syncs and closes the file, and waits for rotated files to finish
+// compressing. Forward returns an error once the forwarder is closed.
+func (f *FileForwarder) Close(ctx context.Context) error {
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return nil
+	}
+	f.closed = true
+
+	err := f.closeFile()
+	f.mutex.Unlock()
+
+	if f.signals != nil {
+		signal.Stop(f.signals)
+	}
+	close(f.stop)
+
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeFile syncs any unsynced writes before closing the file, regardless of
+// the sync mode. The file is nil until it is opened again.
+func (f *FileForwarder) closeFile() error {
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Sync()
+	f.dirty = false
+
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.file = nil
+
+	return err
+}
+
+func (f *FileForwarder) rotate() error {
+	if err := f.closeFile(); err != nil {
+		f.Logger.Printf("FileForwarder: could not close %s before rotating: %s", f.Filename, err)
+	}
+
+	rotated := f.Filename + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(f.Filename, rotated); err != nil {
+		// Keep writing to the current file rather than losing logs
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+
+	f.wg.Add(1)
+	go f.processBackup(rotated)
+
+	return f.open()
+}
+
+func (f *FileForwarder) shouldRotate(size int) bool {
+	if f.size == 0 {
+		return false
+	}
+
+	if f.MaxSize > 0 && f.size+int64(size) > f.MaxSize {
+		return true
+	}
+
+	return f.RotateInterval > 0 && time.Since(f.opened) >= f.RotateInterval
+}
+
+// processBackup compresses a rotated file if configured and removes the
+// oldest backups beyond MaxBackups.
+func (f *FileForwarder) processBackup(rotated string) {
+	defer f.wg.Done()
+
+	f.backupMutex.Lock()
+	defer f.backupMutex.Unlock()
+
+	if f.Compress {
+		if err := compressFile(rotated); err != nil {
+			f.Logger.Printf("FileForwarder: could not compress %s: %s", rotated, err)
+		}
+	}
+
+	if f.MaxBackups <= 0 {
 		return
 	}
 
-	err = writer.Flush()
+	matches, err := filepath.Glob(f.Filename + ".*")
 	if err != nil {
-		f.Logger.Print(err)
 		return
 	}
+
+	var backups []string
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, f.Filename+"."), ".gz")
+		if _, err := time.Parse(rotatedTimeFormat, suffix); err == nil {
+			backups = append(backups, match)
+		}
+	}
+
+	// Timestamp suffixes sort in the order the files were rotated
+	sort.Strings(backups)
+
+	for len(backups) > f.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			f.Logger.Printf("FileForwarder: could not remove old backup %s: %s", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+func compressFile(filename string) error {
+	input, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.Create(filename + ".gz")
+	if err != nil {
+		return err
+	}
+
+	writer, err := compress.Gzip.NewWriter(output)
+	if err == nil {
+		_, err = bufio.NewReader(input).WriteTo(writer)
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(filename + ".gz")
+		return err
+	}
+
+	return os.Remove(filename)
+}
+
+// Forward appends the buffer to the file with a single write, so that batches
+// from concurrent processes are not interleaved.
+func (f *FileForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return Permanent(errFileForwarderClosed)
+	}
+
+	if f.shouldRotate(buffer.Len()) {
+		if err := f.rotate(); err != nil {
+			f.Logger.Printf("FileForwarder: could not rotate %s: %s", f.Filename, err)
+		}
+	}
+
+	// A previous reopen or rotation failed
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(buffer.Bytes())
+	f.size += int64(n)
+	f.dirty = f.dirty || n > 0
+	if err != nil {
+		return err
+	}
+
+	if f.Sync == SyncBatch {
+		f.dirty = false
+		return f.file.Sync()
+	}
+
+	return nil
 }
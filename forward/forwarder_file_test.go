@@ -0,0 +1,213 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readBackups(test *testing.T, filename string) []string {
+	matches, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		test.Fatal(err)
+	}
+	return matches
+}
+
+// Files should be rotated before a write would exceed MaxSize, keeping at
+// most MaxBackups rotated files
+func TestFileForwarderRotateSize(test *testing.T) {
+	dir, err := ioutil.TempDir("", "file-forwarder")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "app.log")
+	forwarder, err := NewFileForwarderWithConfig(filename, FileConfig{
+		MaxSize:    20,
+		MaxBackups: 2,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := forwarder.Forward(context.Background(), bytes.NewBufferString("test log line\n")); err != nil {
+			test.Fatal(err)
+		}
+		// Keep rotated file names distinct
+		time.Sleep(time.Millisecond)
+	}
+
+	waitFor(test, func() bool { return len(readBackups(test, filename)) == 2 })
+
+	current, _ := ioutil.ReadFile(filename)
+	if string(current) != "test log line\n" {
+		test.Fatalf("expected a single line in the current file, got \"%s\"", current)
+	}
+}
+
+// Rotated files should be gzipped when Compress is set
+func TestFileForwarderCompress(test *testing.T) {
+	dir, err := ioutil.TempDir("", "file-forwarder")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "app.log")
+	forwarder, err := NewFileForwarderWithConfig(filename, FileConfig{
+		Compress: true,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	forwarder.Forward(context.Background(), bytes.NewBufferString("test log line\n"))
+	if err := forwarder.Rotate(); err != nil {
+		test.Fatal(err)
+	}
+
+	waitFor(test, func() bool {
+		backups := readBackups(test, filename)
+		return len(backups) == 1 && strings.HasSuffix(backups[0], ".gz")
+	})
+}
+
+// Reopen should start a new file once the current one has been moved aside
+func TestFileForwarderReopen(test *testing.T) {
+	dir, err := ioutil.TempDir("", "file-forwarder")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "app.log")
+	forwarder, err := NewFileForwarder(filename, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	forwarder.Forward(context.Background(), bytes.NewBufferString("before\n"))
+	os.Rename(filename, filename+".moved")
+
+	if err := forwarder.Reopen(); err != nil {
+		test.Fatal(err)
+	}
+	forwarder.Forward(context.Background(), bytes.NewBufferString("after\n"))
+
+	current, _ := ioutil.ReadFile(filename)
+	if string(current) != "after\n" {
+		test.Fatalf("expected \"after\" in the reopened file, got \"%s\"", current)
+	}
+}
+
+// After a failed reopen, Forward should open the file again once possible
+func TestFileForwarderReopenFailure(test *testing.T) {
+	dir, err := ioutil.TempDir("", "file-forwarder")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logDir := filepath.Join(dir, "logs")
+	filename := filepath.Join(logDir, "app.log")
+	forwarder, err := NewFileForwarder(filename, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// A file in place of the directory makes opening fail
+	os.RemoveAll(logDir)
+	ioutil.WriteFile(logDir, nil, 0644)
+
+	if err := forwarder.Reopen(); err == nil {
+		test.Fatal("expected reopen to fail")
+	}
+
+	if err := forwarder.Forward(context.Background(), bytes.NewBufferString("lost\n")); err == nil {
+		test.Fatal("expected forward to fail while the file cannot be opened")
+	}
+
+	os.Remove(logDir)
+
+	if err := forwarder.Forward(context.Background(), bytes.NewBufferString("after\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	if err := forwarder.Close(context.Background()); err != nil {
+		test.Fatal(err)
+	}
+
+	current, _ := ioutil.ReadFile(filename)
+	if string(current) != "after\n" {
+		test.Fatalf("expected \"after\" in the reopened file, got \"%s\"", current)
+	}
+}
+
+// Reopening an existing file should append to it rather than overwrite it
+func TestFileForwarderAppends(test *testing.T) {
+	dir, err := ioutil.TempDir("", "file-forwarder")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "app.log")
+	for _, line := range []string{"first run\n", "second run\n"} {
+		forwarder, err := NewFileForwarderWithConfig(filename, FileConfig{
+			Sync: SyncBatch,
+		})
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		if err := forwarder.Forward(context.Background(), bytes.NewBufferString(line)); err != nil {
+			test.Fatal(err)
+		}
+
+		if err := forwarder.Close(context.Background()); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	actual, _ := ioutil.ReadFile(filename)
+	expected := "first run\nsecond run\n"
+	if string(actual) != expected {
+		test.Fatalf("expected \"%s\", got \"%s\"", expected, actual)
+	}
+}
+
+// Forwarding to a closed forwarder should fail permanently
+func TestFileForwarderClosed(test *testing.T) {
+	dir, err := ioutil.TempDir("", "file-forwarder")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	forwarder, err := NewFileForwarderWithConfig(filepath.Join(dir, "app.log"), FileConfig{
+		Sync:           SyncPeriodic,
+		SyncInterval:   time.Millisecond,
+		ReopenOnSIGHUP: true,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	forwarder.Forward(context.Background(), bytes.NewBufferString("test log line\n"))
+	if err := forwarder.Close(context.Background()); err != nil {
+		test.Fatal(err)
+	}
+
+	err = forwarder.Forward(context.Background(), bytes.NewBufferString("test log line\n"))
+	if !IsPermanent(err) {
+		test.Fatalf("expected a permanent error after closing, got %v", err)
+	}
+}
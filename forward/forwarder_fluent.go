@@ -0,0 +1,349 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/timberio/timber-go/logging"
+)
+
+var (
+	defaultFluentTimestampField = "dt"
+	defaultFluentAckTimeout     = 60 * time.Second
+)
+
+// FluentForwarder sends buffers to Fluentd or Fluent Bit using the Forward
+// protocol in PackedForward mode, over TCP or a Unix domain socket.
+type FluentForwarder struct {
+	Network string
+	Address string
+
+	FluentConfig
+
+	conn *reconnectingConn
+}
+
+type FluentConfig struct {
+	// Tag routes the events within Fluentd. It defaults to the program name.
+	Tag string
+	// TimestampField is the JSON field holding a line's RFC 3339 timestamp,
+	// used as the event time. Lines without one use the time they were
+	// forwarded.
+	TimestampField string
+
+	// RequireAck sends a chunk ID with every buffer and waits up to
+	// AckTimeout for the server to acknowledge it. A buffer that is not
+	// acknowledged may have been received, so retrying it can duplicate
+	// events.
+	RequireAck bool
+	AckTimeout time.Duration
+
+	// SharedKey enables the handshake of servers configured with a
+	// <security> section. Username and Password are sent when the server
+	// also requires user authentication.
+	SharedKey string
+	Username  string
+	Password  string
+	// Hostname identifies this client during the handshake.
+	Hostname string
+
+	// TLSConfig, when set, wraps TCP connections in TLS.
+	TLSConfig *tls.Config
+
+	// The connection is configured like a SocketForwarder's.
+	KeepAlive    time.Duration
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+
+	Logger logging.Logger
+}
+
+func DefaultFluentConfig() FluentConfig {
+	hostname, _ := os.Hostname()
+
+	return FluentConfig{
+		Tag:            filepath.Base(os.Args[0]),
+		TimestampField: defaultFluentTimestampField,
+		AckTimeout:     defaultFluentAckTimeout,
+		Hostname:       hostname,
+
+		KeepAlive:    defaultSocketKeepAlive,
+		DialTimeout:  defaultSocketDialTimeout,
+		WriteTimeout: defaultSocketWriteTimeout,
+		MinBackoff:   defaultMinBackoff,
+		MaxBackoff:   defaultMaxBackoff,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+// NewFluentForwarder creates a forwarder for the Fluent server listening at
+// address on network, which is "tcp" or "unix".
+func NewFluentForwarder(network string, address string, config FluentConfig) (*FluentForwarder, error) {
+	if network != "tcp" && network != "unix" {
+		return nil, fmt.Errorf("FluentForwarder: unsupported network %q", network)
+	}
+
+	defaultConfig := DefaultFluentConfig()
+
+	if config.Tag == "" {
+		config.Tag = defaultConfig.Tag
+	}
+
+	if config.TimestampField == "" {
+		config.TimestampField = defaultConfig.TimestampField
+	}
+
+	if config.AckTimeout == 0 {
+		config.AckTimeout = defaultConfig.AckTimeout
+	}
+
+	if config.Hostname == "" {
+		config.Hostname = defaultConfig.Hostname
+	}
+
+	if config.KeepAlive == 0 {
+		config.KeepAlive = defaultConfig.KeepAlive
+	}
+
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultConfig.DialTimeout
+	}
+
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = defaultConfig.WriteTimeout
+	}
+
+	if config.MinBackoff == 0 {
+		config.MinBackoff = defaultConfig.MinBackoff
+	}
+
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaultConfig.MaxBackoff
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	f := &FluentForwarder{
+		Network:      network,
+		Address:      address,
+		FluentConfig: config,
+	}
+
+	f.conn = newReconnectingConn(f.dial, config.WriteTimeout, config.MinBackoff, config.MaxBackoff)
+
+	return f, nil
+}
+
+func (f *FluentForwarder) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   f.DialTimeout,
+		KeepAlive: f.KeepAlive,
+	}
+
+	var conn net.Conn
+	var err error
+	if f.Network == "tcp" && f.TLSConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: f.TLSConfig}
+		conn, err = tlsDialer.DialContext(ctx, f.Network, f.Address)
+	} else {
+		conn, err = dialer.DialContext(ctx, f.Network, f.Address)
+	}
+
+	if err != nil || f.SharedKey == "" {
+		return conn, err
+	}
+
+	if err := f.handshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// handshake answers the server's HELO with a PING and checks its PONG.
+func (f *FluentForwarder) handshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(f.DialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	decoder := &msgpackDecoder{r: conn}
+
+	helo, err := decoder.decode()
+	if err != nil {
+		return fmt.Errorf("FluentForwarder: could not read HELO: %s", err)
+	}
+
+	fields, _ := helo.([]interface{})
+	if len(fields) < 2 || fields[0] != "HELO" {
+		return fmt.Errorf("FluentForwarder: expected HELO, got %v", helo)
+	}
+
+	options, _ := fields[1].(map[string]interface{})
+	nonce, _ := options["nonce"].(string)
+	auth, _ := options["auth"].(string)
+
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return err
+	}
+	salt := hex.EncodeToString(random[:])
+
+	passwordDigest := ""
+	if auth != "" {
+		passwordDigest = sha512Hex(auth, f.Username, f.Password)
+	}
+
+	ping := appendMsgpackArrayHeader(nil, 6)
+	ping = appendMsgpackString(ping, "PING")
+	ping = appendMsgpackString(ping, f.Hostname)
+	ping = appendMsgpackString(ping, salt)
+	ping = appendMsgpackString(ping, sha512Hex(salt, f.Hostname, nonce, f.SharedKey))
+	ping = appendMsgpackString(ping, f.Username)
+	ping = appendMsgpackString(ping, passwordDigest)
+
+	if _, err := conn.Write(ping); err != nil {
+		return err
+	}
+
+	pong, err := decoder.decode()
+	if err != nil {
+		return fmt.Errorf("FluentForwarder: could not read PONG: %s", err)
+	}
+
+	fields, _ = pong.([]interface{})
+	if len(fields) < 5 || fields[0] != "PONG" {
+		return fmt.Errorf("FluentForwarder: expected PONG, got %v", pong)
+	}
+
+	if ok, _ := fields[1].(bool); !ok {
+		return Permanent(fmt.Errorf("FluentForwarder: authentication failed: %v", fields[2]))
+	}
+
+	serverHostname, _ := fields[3].(string)
+	if fields[4] != sha512Hex(salt, serverHostname, nonce, f.SharedKey) {
+		return Permanent(errors.New("FluentForwarder: server failed to prove the shared key"))
+	}
+
+	return nil
+}
+
+func sha512Hex(parts ...string) string {
+	hash := sha512.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Forward sends the lines of buffer as a single PackedForward message. JSON
+// lines are sent as records with the same fields, and other lines as
+// {"message": line}.
+func (f *FluentForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	now := time.Now()
+
+	var entries []byte
+	var count int
+	for _, line := range bytes.Split(buffer.Bytes(), []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		entries = f.appendEntry(entries, line, now)
+		count++
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	var chunk string
+	optionCount := 1
+	if f.RequireAck {
+		var id [16]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return err
+		}
+		chunk = base64.StdEncoding.EncodeToString(id[:])
+		optionCount++
+	}
+
+	message := appendMsgpackArrayHeader(nil, 3)
+	message = appendMsgpackString(message, f.Tag)
+	message = appendMsgpackBinary(message, entries)
+	message = appendMsgpackMapHeader(message, optionCount)
+	message = appendMsgpackString(message, "size")
+	message = appendMsgpackInt(message, int64(count))
+	if f.RequireAck {
+		message = appendMsgpackString(message, "chunk")
+		message = appendMsgpackString(message, chunk)
+	}
+
+	if !f.RequireAck {
+		_, err := f.conn.write(ctx, message)
+		return err
+	}
+
+	_, err := f.conn.writeAndRead(ctx, message, func(conn net.Conn) error {
+		conn.SetReadDeadline(time.Now().Add(f.AckTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+
+		response, err := (&msgpackDecoder{r: conn}).decode()
+		if err != nil {
+			return fmt.Errorf("FluentForwarder: no ack for chunk %s: %s", chunk, err)
+		}
+
+		if fields, _ := response.(map[string]interface{}); fields["ack"] != chunk {
+			return fmt.Errorf("FluentForwarder: expected ack for chunk %s, got %v", chunk, response)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// appendEntry appends the [time, record] entry for line.
+func (f *FluentForwarder) appendEntry(entries []byte, line []byte, now time.Time) []byte {
+	line = bytes.TrimSpace(line)
+
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+
+	var record map[string]interface{}
+	if line[0] != '{' || decoder.Decode(&record) != nil {
+		record = map[string]interface{}{"message": string(line)}
+	}
+
+	timestamp := now
+	if value, ok := record[f.TimestampField].(string); ok {
+		if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			timestamp = parsed
+		}
+	}
+
+	entries = appendMsgpackArrayHeader(entries, 2)
+	entries = appendMsgpackEventTime(entries, timestamp)
+	return appendMsgpackJSON(entries, record)
+}
+
+// Close closes the connection. Forward returns an error once closed.
+func (f *FluentForwarder) Close(ctx context.Context) error {
+	return f.conn.close()
+}
@@ -0,0 +1,183 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fluentServer accepts a single connection, performs the handshake if
+// sharedKey is set, and acknowledges the first message it receives.
+func fluentServer(test *testing.T, listener net.Listener, sharedKey string, messages chan<- []interface{}) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	decoder := &msgpackDecoder{r: conn}
+
+	if sharedKey != "" {
+		helo := appendMsgpackArrayHeader(nil, 2)
+		helo = appendMsgpackString(helo, "HELO")
+		helo = appendMsgpackMapHeader(helo, 1)
+		helo = appendMsgpackString(helo, "nonce")
+		helo = appendMsgpackBinary(helo, []byte("nonce"))
+		conn.Write(helo)
+
+		value, err := decoder.decode()
+		ping, _ := value.([]interface{})
+		if err != nil || len(ping) != 6 || ping[0] != "PING" {
+			test.Errorf("expected PING, got %v (%v)", value, err)
+			return
+		}
+
+		salt, hostname := ping[2].(string), ping[1].(string)
+		authenticated := ping[3] == sha512Hex(salt, hostname, "nonce", sharedKey)
+
+		pong := appendMsgpackArrayHeader(nil, 5)
+		pong = appendMsgpackString(pong, "PONG")
+		pong = appendMsgpackBool(pong, authenticated)
+		pong = appendMsgpackString(pong, "shared key mismatch")
+		pong = appendMsgpackString(pong, "server")
+		pong = appendMsgpackString(pong, sha512Hex(salt, "server", "nonce", sharedKey))
+		conn.Write(pong)
+
+		if !authenticated {
+			return
+		}
+	}
+
+	value, err := decoder.decode()
+	if err != nil {
+		test.Errorf("expected a message: %s", err)
+		return
+	}
+
+	message := value.([]interface{})
+	messages <- message
+
+	if chunk, ok := message[2].(map[string]interface{})["chunk"].(string); ok {
+		ack := appendMsgpackMapHeader(nil, 1)
+		ack = appendMsgpackString(ack, "ack")
+		ack = appendMsgpackString(ack, chunk)
+		conn.Write(ack)
+	}
+}
+
+// Buffers should be sent as acknowledged PackedForward messages after the
+// shared key handshake
+func TestFluentForwarderHandshakeAck(test *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	messages := make(chan []interface{}, 1)
+	go fluentServer(test, listener, "secret", messages)
+
+	forwarder, err := NewFluentForwarder("tcp", listener.Addr().String(), FluentConfig{
+		Tag:        "app.logs",
+		SharedKey:  "secret",
+		RequireAck: true,
+		AckTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	buffer := bytes.NewBufferString(`{"dt":"2019-01-01T00:00:01.5Z","level":"info","count":3}
+plain line
+`)
+
+	if err := forwarder.Forward(context.Background(), buffer); err != nil {
+		test.Fatal(err)
+	}
+
+	message := <-messages
+	if message[0] != "app.logs" || message[2].(map[string]interface{})["size"] != int64(2) {
+		test.Fatalf("unexpected message %v", message)
+	}
+
+	decoder := &msgpackDecoder{r: bytes.NewReader([]byte(message[1].(string)))}
+
+	first, _ := decoder.decode()
+	entry := first.([]interface{})
+	record := entry[1].(map[string]interface{})
+	if !entry[0].(time.Time).Equal(time.Unix(1546300801, 500000000)) || record["level"] != "info" || record["count"] != int64(3) {
+		test.Fatalf("unexpected entry %v", entry)
+	}
+
+	second, _ := decoder.decode()
+	if second.([]interface{})[1].(map[string]interface{})["message"] != "plain line" {
+		test.Fatalf("expected plain lines as messages, got %v", second)
+	}
+}
+
+// A rejected shared key should fail permanently
+func TestFluentForwarderHandshakeRejected(test *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	go fluentServer(test, listener, "secret", nil)
+
+	forwarder, err := NewFluentForwarder("tcp", listener.Addr().String(), FluentConfig{
+		SharedKey: "wrong",
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	err = forwarder.Forward(context.Background(), bytes.NewBufferString("line\n"))
+	if !IsPermanent(err) {
+		test.Fatalf("expected a permanent authentication error, got %v", err)
+	}
+}
+
+func TestFluentForwarderUnix(test *testing.T) {
+	dir, err := ioutil.TempDir("", "timber-fluent")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fluent.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	messages := make(chan []interface{}, 1)
+	go fluentServer(test, listener, "", messages)
+
+	forwarder, err := NewFluentForwarder("unix", path, FluentConfig{Tag: "app"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	if err := forwarder.Forward(context.Background(), bytes.NewBufferString("line\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	select {
+	case message := <-messages:
+		if message[0] != "app" {
+			test.Fatalf("unexpected message %v", message)
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatal("expected a message")
+	}
+}
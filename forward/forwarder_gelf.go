@@ -0,0 +1,356 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/timberio/timber-go/compress"
+	"github.com/timberio/timber-go/logging"
+	"github.com/timberio/timber-go/metadata"
+)
+
+var (
+	defaultGELFNetwork        = "udp"
+	defaultGELFChunkSize      = 1420
+	defaultGELFMessageField   = "message"
+	defaultGELFLevelField     = "level"
+	defaultGELFTimestampField = "dt"
+
+	gelfChunkMagic     = []byte{0x1e, 0x0f}
+	gelfChunkHeaderLen = 12
+	gelfMaxChunks      = 128
+
+	// Characters allowed in additional field names
+	gelfFieldName = regexp.MustCompile(`[^\w\.\-]`)
+)
+
+// GELFForwarder sends every line of a buffer to Graylog as a GELF 1.1
+// message, over UDP or TCP.
+type GELFForwarder struct {
+	Address string
+
+	GELFConfig
+
+	conn *reconnectingConn
+}
+
+type GELFConfig struct {
+	// Network is "udp" or "tcp". UDP messages are compressed and split into
+	// chunks when needed; TCP messages are terminated by a null byte.
+	Network string
+	// TLSConfig, when set, wraps TCP connections in TLS.
+	TLSConfig *tls.Config
+
+	// Host is the host of every message. When empty, the hostname of System
+	// is used, falling back to the hostname of the machine.
+	Host   string
+	System *metadata.SystemContext
+
+	// MessageField, LevelField and TimestampField name the JSON fields mapped
+	// to short_message, level and timestamp. Other fields are sent as
+	// additional fields, with nested fields joined by underscores. Lines that
+	// are not JSON objects become the short_message.
+	MessageField   string
+	LevelField     string
+	TimestampField string
+
+	// Uncompressed disables the gzip compression of UDP messages.
+	Uncompressed bool
+	// ChunkSize is the largest UDP datagram sent, including the chunk header.
+	ChunkSize int
+
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	Logger logging.Logger
+}
+
+func DefaultGELFConfig() GELFConfig {
+	return GELFConfig{
+		Network: defaultGELFNetwork,
+
+		MessageField:   defaultGELFMessageField,
+		LevelField:     defaultGELFLevelField,
+		TimestampField: defaultGELFTimestampField,
+
+		ChunkSize: defaultGELFChunkSize,
+
+		DialTimeout:  defaultSocketDialTimeout,
+		WriteTimeout: defaultSocketWriteTimeout,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+// NewGELFForwarder creates a forwarder for the GELF input listening at
+// address, e.g. "graylog.example.com:12201".
+func NewGELFForwarder(address string, config GELFConfig) (*GELFForwarder, error) {
+	defaultConfig := DefaultGELFConfig()
+
+	if config.Network == "" {
+		config.Network = defaultConfig.Network
+	}
+
+	if config.Network != "udp" && config.Network != "tcp" {
+		return nil, fmt.Errorf("GELFForwarder: unsupported network %q", config.Network)
+	}
+
+	if config.Host == "" && config.System != nil {
+		config.Host = config.System.Hostname
+	}
+
+	if config.Host == "" {
+		config.Host, _ = os.Hostname()
+	}
+
+	if config.MessageField == "" {
+		config.MessageField = defaultConfig.MessageField
+	}
+
+	if config.LevelField == "" {
+		config.LevelField = defaultConfig.LevelField
+	}
+
+	if config.TimestampField == "" {
+		config.TimestampField = defaultConfig.TimestampField
+	}
+
+	if config.ChunkSize == 0 {
+		config.ChunkSize = defaultConfig.ChunkSize
+	}
+
+	if config.ChunkSize <= gelfChunkHeaderLen {
+		return nil, fmt.Errorf("GELFForwarder: chunk size of %d bytes is too small", config.ChunkSize)
+	}
+
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultConfig.DialTimeout
+	}
+
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = defaultConfig.WriteTimeout
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	g := &GELFForwarder{
+		Address:    address,
+		GELFConfig: config,
+	}
+
+	g.conn = newReconnectingConn(g.dial, config.WriteTimeout, defaultMinBackoff, defaultMaxBackoff)
+
+	return g, nil
+}
+
+func (g *GELFForwarder) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: g.DialTimeout}
+
+	if g.Network == "tcp" && g.TLSConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: g.TLSConfig}
+		return tlsDialer.DialContext(ctx, "tcp", g.Address)
+	}
+
+	return dialer.DialContext(ctx, g.Network, g.Address)
+}
+
+// Forward sends each line of buffer as a GELF message. Over TCP the messages
+// are written together; over UDP each is sent in its own datagram or chunks.
+// A failure part way returns a PartialError holding the lines that were not
+// sent in full.
+func (g *GELFForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	now := time.Now()
+	var payload bytes.Buffer
+
+	body := buffer.Bytes()
+	sent := false
+	var frames []frameOffset
+	for offset := 0; offset < len(body); {
+		line := body[offset:]
+		if end := bytes.IndexByte(line, '\n'); end >= 0 {
+			line = line[:end]
+		}
+		start := offset
+		offset += len(line) + 1
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		message, err := json.Marshal(g.message(line, now))
+		if err != nil {
+			return Permanent(err)
+		}
+
+		if g.Network == "tcp" {
+			frames = append(frames, frameOffset{payload: payload.Len(), line: start})
+			payload.Write(message)
+			payload.WriteByte(0)
+			continue
+		}
+
+		if err := g.sendUDP(ctx, message); err != nil {
+			if sent {
+				return Partial(body[start:], err)
+			}
+			return err
+		}
+		sent = true
+	}
+
+	if payload.Len() == 0 {
+		return nil
+	}
+
+	_, err := g.conn.write(ctx, payload.Bytes())
+	return unwrittenLines(err, body, frames)
+}
+
+// sendUDP compresses message unless disabled and sends it in as many chunks
+// as ChunkSize requires. Messages needing more chunks than GELF allows are
+// logged and dropped, since Graylog would discard them anyway.
+func (g *GELFForwarder) sendUDP(ctx context.Context, message []byte) error {
+	if !g.Uncompressed {
+		var compressed bytes.Buffer
+		if err := compress.Encode(compress.Gzip, &compressed, message); err != nil {
+			return Permanent(err)
+		}
+		message = compressed.Bytes()
+	}
+
+	if len(message) <= g.ChunkSize {
+		_, err := g.conn.write(ctx, message)
+		return err
+	}
+
+	dataSize := g.ChunkSize - gelfChunkHeaderLen
+	count := (len(message) + dataSize - 1) / dataSize
+	if count > gelfMaxChunks {
+		g.Logger.Printf("GELFForwarder: dropping message of %d bytes, which needs %d chunks, more than the limit of %d", len(message), count, gelfMaxChunks)
+		return nil
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 0, g.ChunkSize)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * dataSize
+		if end > len(message) {
+			end = len(message)
+		}
+
+		chunk = append(chunk[:0], gelfChunkMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, message[i*dataSize:end]...)
+
+		if _, err := g.conn.write(ctx, chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// message maps a line to the fields of a GELF message.
+func (g *GELFForwarder) message(line []byte, now time.Time) map[string]interface{} {
+	message := map[string]interface{}{
+		"version": "1.1",
+		"host":    g.Host,
+	}
+
+	timestamp := now
+	level := SeverityInfo
+
+	trimmed := bytes.TrimSpace(line)
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	if trimmed[0] != '{' || decoder.Decode(&fields) != nil {
+		fields = nil
+		message["short_message"] = string(trimmed)
+	}
+
+	if fields != nil {
+		if value, ok := fields[g.TimestampField].(string); ok {
+			if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				timestamp = parsed
+				delete(fields, g.TimestampField)
+			}
+		}
+
+		if value, ok := fields[g.LevelField].(string); ok {
+			level = syslogSeverity(value)
+			delete(fields, g.LevelField)
+		}
+
+		if value, ok := fields[g.MessageField].(string); ok && value != "" {
+			message["short_message"] = value
+			delete(fields, g.MessageField)
+		} else {
+			// short_message is required
+			message["short_message"] = string(trimmed)
+		}
+
+		addGELFFields(message, "", fields)
+	}
+
+	message["timestamp"] = json.Number(strconv.FormatFloat(float64(timestamp.UnixNano()/int64(time.Millisecond))/1000, 'f', 3, 64))
+	message["level"] = level
+
+	return message
+}
+
+// addGELFFields adds fields as additional fields, prefixed with an underscore
+// and flattening nested objects. Values other than strings and numbers are
+// sent as their JSON encoding.
+func addGELFFields(message map[string]interface{}, prefix string, fields map[string]interface{}) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := prefix + gelfFieldName.ReplaceAllString(key, "_")
+
+		switch value := fields[key].(type) {
+		case map[string]interface{}:
+			addGELFFields(message, name+"_", value)
+		case string, json.Number:
+			message["_"+gelfFieldKey(name)] = value
+		default:
+			encoded, _ := json.Marshal(value)
+			message["_"+gelfFieldKey(name)] = string(encoded)
+		}
+	}
+}
+
+// gelfFieldKey avoids the reserved _id field.
+func gelfFieldKey(name string) string {
+	if name == "id" {
+		return "id_"
+	}
+	return name
+}
+
+// Close closes the connection. Forward returns an error once closed.
+func (g *GELFForwarder) Close(ctx context.Context) error {
+	return g.conn.close()
+}
@@ -0,0 +1,279 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timberio/timber-go/logging"
+	"github.com/timberio/timber-go/metadata"
+)
+
+// Lines should be sent as gzipped GELF messages, one per datagram
+func TestGELFForwarderUDP(test *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	forwarder, err := NewGELFForwarder(listener.LocalAddr().String(), GELFConfig{
+		System: &metadata.SystemContext{Hostname: "web-1"},
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	line := `{"dt":"2019-01-01T00:00:01.5Z","level":"error","message":"failed","id":7,"http":{"status":500}}`
+	if err := forwarder.Forward(context.Background(), bytes.NewBufferString(line+"\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	datagram := make([]byte, 2048)
+	n, _, err := listener.ReadFrom(datagram)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(datagram[:n]))
+	if err != nil {
+		test.Fatal(err)
+	}
+	decompressed, _ := ioutil.ReadAll(reader)
+
+	var message map[string]interface{}
+	if err := json.Unmarshal(decompressed, &message); err != nil {
+		test.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"version":       "1.1",
+		"host":          "web-1",
+		"short_message": "failed",
+		"timestamp":     1546300801.5,
+		"level":         float64(SeverityError),
+		"_id_":          float64(7),
+		"_http_status":  float64(500),
+	}
+
+	for key, value := range expected {
+		if message[key] != value {
+			test.Fatalf("expected %s to be %v, got %v in %s", key, value, message[key], decompressed)
+		}
+	}
+}
+
+// Messages larger than ChunkSize should be split into GELF chunks
+func TestGELFForwarderChunking(test *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	forwarder, err := NewGELFForwarder(listener.LocalAddr().String(), GELFConfig{
+		Uncompressed: true,
+		ChunkSize:    100,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	line := strings.Repeat("x", 300)
+	if err := forwarder.Forward(context.Background(), bytes.NewBufferString(line+"\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var chunks [][]byte
+	for count := 1; len(chunks) < count; {
+		datagram := make([]byte, 2048)
+		n, _, err := listener.ReadFrom(datagram)
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		chunk := datagram[:n]
+		if n > 100 || !bytes.HasPrefix(chunk, gelfChunkMagic) || int(chunk[10]) != len(chunks) {
+			test.Fatalf("unexpected chunk %x", chunk)
+		}
+
+		count = int(chunk[11])
+		chunks = append(chunks, chunk)
+	}
+
+	var reassembled []byte
+	for _, chunk := range chunks {
+		if !bytes.Equal(chunk[2:10], chunks[0][2:10]) {
+			test.Fatal("expected every chunk to have the same message ID")
+		}
+		reassembled = append(reassembled, chunk[gelfChunkHeaderLen:]...)
+	}
+
+	var message map[string]interface{}
+	if err := json.Unmarshal(reassembled, &message); err != nil || message["short_message"] != line {
+		test.Fatalf("unexpected reassembled message %s", reassembled)
+	}
+}
+
+// Messages sent over TCP should be terminated by null bytes
+func TestGELFForwarderTCP(test *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	messages := make(chan string, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		for {
+			message, err := reader.ReadString(0)
+			if err != nil {
+				return
+			}
+			messages <- strings.TrimSuffix(message, "\x00")
+		}
+	}()
+
+	forwarder, err := NewGELFForwarder(listener.Addr().String(), GELFConfig{Network: "tcp"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	if err := forwarder.Forward(context.Background(), bytes.NewBufferString("first\nsecond\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case received := <-messages:
+			var message map[string]interface{}
+			if err := json.Unmarshal([]byte(received), &message); err != nil || message["short_message"] != expected {
+				test.Fatalf("expected short_message %s, got %s", expected, received)
+			}
+		case <-time.After(5 * time.Second):
+			test.Fatalf("expected to receive %s", expected)
+		}
+	}
+}
+
+// The hostname of System should be used even when starting from the default
+// config
+func TestGELFForwarderSystemHostname(test *testing.T) {
+	config := DefaultGELFConfig()
+	config.System = &metadata.SystemContext{Hostname: "web-1"}
+
+	forwarder, err := NewGELFForwarder("127.0.0.1:12201", config)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	if forwarder.Host != "web-1" {
+		test.Fatalf("expected host web-1, got %s", forwarder.Host)
+	}
+}
+
+// Messages needing more than 128 chunks should be dropped without failing the
+// rest of the buffer
+func TestGELFForwarderTooManyChunks(test *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	forwarder, err := NewGELFForwarder(listener.LocalAddr().String(), GELFConfig{
+		Uncompressed: true,
+		ChunkSize:    1000,
+		Logger:       logging.DiscardingLogger,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	huge := strings.Repeat("x", 200000)
+	if err := forwarder.Forward(context.Background(), bytes.NewBufferString(huge+"\nsmall\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	datagram := make([]byte, 2048)
+	n, _, err := listener.ReadFrom(datagram)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	var message map[string]interface{}
+	if err := json.Unmarshal(datagram[:n], &message); err != nil || message["short_message"] != "small" {
+		test.Fatalf("expected only the small message, got %s", datagram[:n])
+	}
+}
+
+// A UDP failure part way through a buffer should leave only the unsent lines
+// for a retry
+func TestGELFForwarderUDPPartial(test *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	forwarder, err := NewGELFForwarder(listener.LocalAddr().String(), GELFConfig{
+		Uncompressed: true,
+		ChunkSize:    100000,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	// Too large for a single datagram
+	large := strings.Repeat("x", 70000) + "\n"
+	buffer := bytes.NewBufferString("first\n" + large + "last\n")
+
+	err = forwarder.Forward(context.Background(), buffer)
+	if err == nil || Remaining(buffer, err).String() != large+"last\n" {
+		test.Fatalf("expected the lines from the failed one on to remain, got %v", err)
+	}
+}
+
+// A TCP write failing part way should leave the lines whose messages were not
+// completely written for a retry
+func TestGELFForwarderTCPPartial(test *testing.T) {
+	forwarder, err := NewGELFForwarder("127.0.0.1:12201", GELFConfig{Network: "tcp"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	forwarder.conn = newReconnectingConn(func(ctx context.Context) (net.Conn, error) {
+		return halfConn{}, nil
+	}, 0, time.Millisecond, time.Millisecond)
+
+	// Half of the payload ends in the middle of the second message
+	buffer := bytes.NewBufferString("a\nb\nc\n")
+	err = forwarder.Forward(context.Background(), buffer)
+
+	if err == nil || Remaining(buffer, err).String() != "b\nc\n" {
+		test.Fatalf("expected the second and third lines to remain, got %v", err)
+	}
+}
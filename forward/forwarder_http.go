@@ -2,12 +2,15 @@ package forward
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
+	"github.com/timberio/timber-go/compress"
 	"github.com/timberio/timber-go/logging"
 )
 
@@ -31,6 +34,10 @@ type Config struct {
 	Metadata  string
 	UserAgent string
 
+	// Compression, when set, compresses each request body and sets the
+	// Content-Encoding header accordingly.
+	Compression compress.Codec
+
 	Logger logging.Logger
 }
 
@@ -62,28 +69,40 @@ func NewHTTPForwarder(apiKey string, config Config) (*HTTPForwarder, error) {
 		config.Logger = defaultConfig.Logger
 	}
 
-	httpClient := retryablehttp.NewClient()
-	httpClient.Logger = logging.DiscardingLogger
-	httpClient.HTTPClient.Timeout = defaultHTTPForwarderTimeout
-
 	return &HTTPForwarder{
-		HTTPClient: httpClient,
+		HTTPClient: newRetryableClient(defaultHTTPForwarderTimeout),
 		APIKey:     apiKey,
 		Config:     config,
 	}, nil
 }
 
-func (h *HTTPForwarder) Forward(buffer *bytes.Buffer) {
+func (h *HTTPForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	return h.send(ctx, buffer.Bytes())
+}
+
+func (h *HTTPForwarder) send(ctx context.Context, body []byte) error {
 	token := base64.StdEncoding.EncodeToString([]byte(h.APIKey))
 	authorization := fmt.Sprintf("Basic %s", token)
 
-	req, err := retryablehttp.NewRequest("POST", h.Endpoint, bytes.NewReader(buffer.Bytes()))
+	payload := body
+	if h.Compression != nil {
+		var compressed bytes.Buffer
+		if err := compress.Encode(h.Compression, &compressed, body); err != nil {
+			return Permanent(err)
+		}
+		payload = compressed.Bytes()
+	}
+
+	req, err := retryablehttp.NewRequest("POST", h.Endpoint, bytes.NewReader(payload))
 	if err != nil {
-		h.Logger.Print(err)
-		return
+		return Permanent(err)
 	}
+	req = req.WithContext(ctx)
 
 	req.Header.Add("Content-Type", "text/plain")
+	if h.Compression != nil {
+		req.Header.Add("Content-Encoding", h.Compression.Encoding())
+	}
 	req.Header.Add("Authorization", authorization)
 	req.Header.Add("User-Agent", h.UserAgent)
 	req.Header.Add("Timber-Metadata-Override", h.Metadata)
@@ -91,14 +110,77 @@ func (h *HTTPForwarder) Forward(buffer *bytes.Buffer) {
 	resp, err := h.HTTPClient.Do(req)
 	if err != nil {
 		// retries have already happened at this point, so give up
-		h.Logger.Print(err)
-		return
+		return err
 	}
-	resp.Body.Close()
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		return nil
+	}
+
+	err = statusError("HTTPForwarder", resp)
+
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return h.split(ctx, body, err)
+	}
+
+	return err
+}
 
-	if resp.StatusCode >= 300 {
-		//@TODO: More informative logging message
-		h.Logger.Printf("HTTPForwarder: unexpected response (status code %d)", resp.StatusCode)
-		return
+// split halves a rejected body at a line boundary and sends each half,
+// recursing until the halves are accepted or cannot be split further. It stops
+// at the first retryable failure, returning a PartialError with the lines that
+// were not delivered once any were, so that accepted halves are not resent.
+func (h *HTTPForwarder) split(ctx context.Context, body []byte, rejected error) error {
+	half := splitIndex(body)
+	if half < 0 {
+		// A single line cannot be split
+		return Permanent(rejected)
 	}
+
+	h.Logger.Printf("HTTPForwarder: payload of %d bytes too large, splitting it in two", len(body))
+
+	first, second := body[:half], body[half:]
+
+	firstErr := h.send(ctx, first)
+	if firstErr != nil && !IsPermanent(firstErr) {
+		if remaining := remainder(first, firstErr); len(remaining) < len(first) {
+			return Partial(append(append([]byte(nil), remaining...), second...), firstErr)
+		}
+		return firstErr
+	}
+
+	secondErr := h.send(ctx, second)
+
+	switch {
+	case firstErr == nil && secondErr == nil:
+		return nil
+	case firstErr == nil:
+		return Partial(remainder(second, secondErr), secondErr)
+	case secondErr == nil:
+		return Partial(remainder(first, firstErr), firstErr)
+	case !IsPermanent(secondErr):
+		// The lines rejected in the first half cannot be retried
+		h.Logger.Printf("HTTPForwarder: dropping %d bytes: %s", len(remainder(first, firstErr)), firstErr)
+		return Partial(remainder(second, secondErr), secondErr)
+	default:
+		remaining := append(append([]byte(nil), remainder(first, firstErr)...), remainder(second, secondErr)...)
+		return Partial(remaining, firstErr)
+	}
+}
+
+// splitIndex returns the offset of the line boundary closest to the middle of
+// body, or -1 if body holds a single line.
+func splitIndex(body []byte) int {
+	middle := len(body) / 2
+
+	if i := bytes.LastIndexByte(body[:middle], '\n'); i >= 0 {
+		return i + 1
+	}
+
+	if i := bytes.IndexByte(body[middle:], '\n'); i >= 0 && middle+i+1 < len(body) {
+		return middle + i + 1
+	}
+
+	return -1
 }
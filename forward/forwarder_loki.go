@@ -0,0 +1,454 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/timberio/timber-go/compress"
+	"github.com/timberio/timber-go/logging"
+	"github.com/timberio/timber-go/metadata"
+)
+
+var (
+	lokiPushPath = "/loki/api/v1/push"
+
+	defaultLokiTimestampField   = "dt"
+	defaultLokiTimeout          = 30 * time.Second
+	defaultLokiOutOfOrderWindow = time.Hour
+
+	// How often streams past OutOfOrderWindow are forgotten
+	lokiPruneInterval = time.Minute
+
+	lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// ErrLokiOutOfOrder is wrapped by the permanent error returned when Loki
+	// rejects entries older than those it already holds for their stream.
+	// Retrying them would be rejected again.
+	ErrLokiOutOfOrder = errors.New("LokiForwarder: entries out of order")
+)
+
+// LokiEncoding is the body format of push requests.
+type LokiEncoding int
+
+const (
+	// LokiProtobuf sends snappy-compressed protocol buffers.
+	LokiProtobuf LokiEncoding = iota
+	// LokiJSON sends JSON, compressed with Compression if set.
+	LokiJSON
+)
+
+// LokiForwarder sends lines to the Grafana Loki push API, grouped into streams
+// by their labels.
+type LokiForwarder struct {
+	HTTPClient *retryablehttp.Client
+	Endpoint   string
+
+	LokiConfig
+
+	labelPaths map[string][]string
+
+	// Latest timestamp sent for each stream, for ClampOutOfOrder
+	mutex  sync.Mutex
+	latest map[string]lokiLatest
+	pruned time.Time
+}
+
+type lokiLatest struct {
+	timestamp time.Time
+	// When entries were last sent for the stream
+	sent time.Time
+}
+
+type LokiConfig struct {
+	// Labels are added to every stream. When neither Labels nor LabelFields
+	// are set, streams are labelled with the job name of the program.
+	Labels map[string]string
+	// LabelFields maps label names to JSON fields of each line, with nested
+	// fields separated by dots, e.g. {"level": "level", "host":
+	// "context.system.hostname"}. Lines without a field omit the label.
+	LabelFields map[string]string
+	// LogEvent, when set, labels every stream with its context: "host" from
+	// the system hostname and "instance_id" and "instance_type" from EC2.
+	LogEvent *metadata.LogEvent
+
+	// TimestampField is the JSON field holding a line's RFC 3339 timestamp.
+	// Lines without one use the time they were forwarded.
+	TimestampField string
+
+	// ClampOutOfOrder moves entries older than the latest entry already sent
+	// for their stream up to its timestamp, for Loki versions that reject
+	// out-of-order entries. Streams are forgotten once nothing has been sent
+	// for them for OutOfOrderWindow, so that labels taken from lines do not
+	// grow memory without bound.
+	ClampOutOfOrder  bool
+	OutOfOrderWindow time.Duration
+
+	Encoding    LokiEncoding
+	Compression compress.Codec
+
+	// TenantID sets the X-Scope-OrgID header of multi-tenant deployments.
+	TenantID string
+	Username string
+	Password string
+
+	Logger logging.Logger
+}
+
+func DefaultLokiConfig() LokiConfig {
+	return LokiConfig{
+		Labels: map[string]string{
+			"job": filepath.Base(os.Args[0]),
+		},
+		TimestampField: defaultLokiTimestampField,
+
+		OutOfOrderWindow: defaultLokiOutOfOrderWindow,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+// NewLokiForwarder creates a forwarder for the Loki instance at endpoint,
+// e.g. "http://localhost:3100".
+func NewLokiForwarder(endpoint string, config LokiConfig) (*LokiForwarder, error) {
+	if endpoint == "" {
+		return nil, errors.New("LokiForwarder: endpoint required")
+	}
+
+	defaultConfig := DefaultLokiConfig()
+
+	labels := map[string]string{}
+	for name, value := range config.Labels {
+		labels[name] = value
+	}
+	for name, value := range logEventLabels(config.LogEvent) {
+		labels[name] = value
+	}
+	if len(labels) == 0 && len(config.LabelFields) == 0 {
+		labels = defaultConfig.Labels
+	}
+	config.Labels = labels
+
+	labelPaths := map[string][]string{}
+	for name, field := range config.LabelFields {
+		labelPaths[name] = strings.Split(field, ".")
+	}
+
+	for name := range labels {
+		if !lokiLabelName.MatchString(name) {
+			return nil, fmt.Errorf("LokiForwarder: invalid label name %q", name)
+		}
+	}
+	for name := range labelPaths {
+		if !lokiLabelName.MatchString(name) {
+			return nil, fmt.Errorf("LokiForwarder: invalid label name %q", name)
+		}
+	}
+
+	if config.TimestampField == "" {
+		config.TimestampField = defaultConfig.TimestampField
+	}
+
+	if config.OutOfOrderWindow == 0 {
+		config.OutOfOrderWindow = defaultConfig.OutOfOrderWindow
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	return &LokiForwarder{
+		HTTPClient: newRetryableClient(defaultLokiTimeout),
+		Endpoint:   strings.TrimSuffix(endpoint, "/") + lokiPushPath,
+		LokiConfig: config,
+
+		labelPaths: labelPaths,
+		latest:     map[string]lokiLatest{},
+	}, nil
+}
+
+func logEventLabels(logEvent *metadata.LogEvent) map[string]string {
+	labels := map[string]string{}
+	if logEvent == nil || logEvent.Context == nil {
+		return labels
+	}
+
+	if system := logEvent.Context.System; system != nil && system.Hostname != "" {
+		labels["host"] = system.Hostname
+	}
+
+	if platform := logEvent.Context.Platform; platform != nil && platform.AWSEC2 != nil {
+		if platform.AWSEC2.InstanceID != "" {
+			labels["instance_id"] = platform.AWSEC2.InstanceID
+		}
+		if platform.AWSEC2.InstanceType != "" {
+			labels["instance_type"] = platform.AWSEC2.InstanceType
+		}
+	}
+
+	return labels
+}
+
+type lokiEntry struct {
+	timestamp time.Time
+	line      []byte
+}
+
+type lokiStream struct {
+	key     string
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+// Forward pushes the lines of buffer in a single request. Entries are sorted
+// by timestamp within each stream.
+func (l *LokiForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	now := time.Now()
+	streams := l.streams(buffer.Bytes(), now)
+	if len(streams) == 0 {
+		return nil
+	}
+
+	var payload []byte
+	var contentType string
+	if l.Encoding == LokiJSON {
+		payload, contentType = encodeLokiJSON(streams), "application/json"
+	} else {
+		payload, contentType = snappy.Encode(nil, encodeLokiProtobuf(streams)), "application/x-protobuf"
+	}
+
+	compressed := l.Encoding == LokiJSON && l.Compression != nil
+	if compressed {
+		var body bytes.Buffer
+		if err := compress.Encode(l.Compression, &body, payload); err != nil {
+			return Permanent(err)
+		}
+		payload = body.Bytes()
+	}
+
+	req, err := retryablehttp.NewRequest("POST", l.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return Permanent(err)
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Add("Content-Type", contentType)
+	if compressed {
+		req.Header.Add("Content-Encoding", l.Compression.Encoding())
+	}
+	if l.TenantID != "" {
+		req.Header.Add("X-Scope-OrgID", l.TenantID)
+	}
+	if l.Username != "" {
+		req.SetBasicAuth(l.Username, l.Password)
+	}
+
+	resp, err := l.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		l.accepted(streams, now)
+		return nil
+	}
+
+	if resp.StatusCode == http.StatusBadRequest {
+		body := responseSnippet(resp.Body)
+		if strings.Contains(body, "out of order") || strings.Contains(body, "too far behind") {
+			l.Logger.Printf("LokiForwarder: out-of-order entries were rejected: %s", body)
+			return Permanent(fmt.Errorf("%w: %s", ErrLokiOutOfOrder, body))
+		}
+		resp.Body = ioutil.NopCloser(strings.NewReader(body))
+	}
+
+	return statusError("LokiForwarder", resp)
+}
+
+// streams groups the lines of body by their labels.
+func (l *LokiForwarder) streams(body []byte, now time.Time) []*lokiStream {
+	byKey := map[string]*lokiStream{}
+	var streams []*lokiStream
+
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		labels := l.labels(line)
+		key := lokiLabelString(labels)
+
+		stream, ok := byKey[key]
+		if !ok {
+			stream = &lokiStream{key: key, labels: labels}
+			byKey[key] = stream
+			streams = append(streams, stream)
+		}
+
+		timestamp := now
+		if value, ok := jsonField(line, []string{l.TimestampField}); ok {
+			if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				timestamp = parsed
+			}
+		}
+
+		stream.entries = append(stream.entries, lokiEntry{timestamp: timestamp, line: line})
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.ClampOutOfOrder && now.Sub(l.pruned) >= lokiPruneInterval {
+		for key, latest := range l.latest {
+			if now.Sub(latest.sent) > l.OutOfOrderWindow {
+				delete(l.latest, key)
+			}
+		}
+		l.pruned = now
+	}
+
+	for _, stream := range streams {
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].timestamp.Before(stream.entries[j].timestamp)
+		})
+
+		if !l.ClampOutOfOrder {
+			continue
+		}
+
+		latest := l.latest[stream.key].timestamp
+		for i := range stream.entries {
+			if stream.entries[i].timestamp.Before(latest) {
+				stream.entries[i].timestamp = latest
+			}
+		}
+	}
+
+	return streams
+}
+
+// accepted records the latest timestamp of every stream once Loki has accepted
+// them, so that ClampOutOfOrder never clamps to entries that were not stored.
+func (l *LokiForwarder) accepted(streams []*lokiStream, now time.Time) {
+	if !l.ClampOutOfOrder {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, stream := range streams {
+		timestamp := stream.entries[len(stream.entries)-1].timestamp
+		if latest := l.latest[stream.key].timestamp; latest.After(timestamp) {
+			// A concurrent push got further
+			timestamp = latest
+		}
+
+		l.latest[stream.key] = lokiLatest{
+			timestamp: timestamp,
+			sent:      now,
+		}
+	}
+}
+
+func (l *LokiForwarder) labels(line []byte) map[string]string {
+	labels := make(map[string]string, len(l.Labels)+len(l.labelPaths))
+	for name, value := range l.Labels {
+		labels[name] = value
+	}
+
+	for name, path := range l.labelPaths {
+		if value, ok := jsonField(line, path); ok {
+			labels[name] = value
+		}
+	}
+
+	return labels
+}
+
+// lokiLabelString formats labels as a Prometheus label set, e.g.
+// {host="web-1", job="app"}, with names sorted.
+func lokiLabelString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+type lokiJSONRequest struct {
+	Streams []lokiJSONStream `json:"streams"`
+}
+
+type lokiJSONStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func encodeLokiJSON(streams []*lokiStream) []byte {
+	request := lokiJSONRequest{Streams: make([]lokiJSONStream, len(streams))}
+
+	for i, stream := range streams {
+		values := make([][2]string, len(stream.entries))
+		for j, entry := range stream.entries {
+			values[j] = [2]string{strconv.FormatInt(entry.timestamp.UnixNano(), 10), string(entry.line)}
+		}
+
+		request.Streams[i] = lokiJSONStream{Stream: stream.labels, Values: values}
+	}
+
+	encoded, _ := json.Marshal(request)
+	return encoded
+}
+
+// encodeLokiProtobuf encodes a logproto.PushRequest.
+func encodeLokiProtobuf(streams []*lokiStream) []byte {
+	var request, stream, entry, timestamp []byte
+
+	for _, s := range streams {
+		stream = appendProtoString(stream[:0], 1, lokiLabelString(s.labels))
+
+		for _, e := range s.entries {
+			timestamp = appendProtoVarint(timestamp[:0], 1, uint64(e.timestamp.Unix()))
+			timestamp = appendProtoVarint(timestamp, 2, uint64(e.timestamp.Nanosecond()))
+
+			entry = appendProtoBytes(entry[:0], 1, timestamp)
+			entry = appendProtoBytes(entry, 2, e.line)
+
+			stream = appendProtoBytes(stream, 2, entry)
+		}
+
+		request = appendProtoBytes(request, 1, stream)
+	}
+
+	return request
+}
@@ -0,0 +1,157 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/timberio/timber-go/metadata"
+)
+
+// Lines should be grouped into streams by their labels, sorted by timestamp
+func TestLokiForwarderJSON(test *testing.T) {
+	requests := make(chan lokiJSONRequest, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != lokiPushPath || r.Header.Get("X-Scope-OrgID") != "team-a" {
+			test.Errorf("unexpected request to %s for tenant %s", r.URL.Path, r.Header.Get("X-Scope-OrgID"))
+		}
+
+		var request lokiJSONRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		requests <- request
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	logEvent := metadata.NewLogEvent()
+	logEvent.AddHostname("web-1")
+
+	forwarder, err := NewLokiForwarder(server.URL, LokiConfig{
+		LabelFields: map[string]string{"level": "level"},
+		LogEvent:    logEvent,
+		Encoding:    LokiJSON,
+		TenantID:    "team-a",
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	buffer := bytes.NewBufferString(`{"dt":"2019-01-01T00:00:02Z","level":"info","message":"second"}
+{"dt":"2019-01-01T00:00:01Z","level":"info","message":"first"}
+{"dt":"2019-01-01T00:00:03Z","level":"error","message":"failed"}
+`)
+
+	if err := forwarder.Forward(context.Background(), buffer); err != nil {
+		test.Fatal(err)
+	}
+
+	request := <-requests
+	if len(request.Streams) != 2 {
+		test.Fatalf("expected 2 streams, got %+v", request.Streams)
+	}
+
+	info := request.Streams[0]
+	if info.Stream["level"] != "info" || info.Stream["host"] != "web-1" {
+		test.Fatalf("unexpected labels %v", info.Stream)
+	}
+
+	if len(info.Values) != 2 || info.Values[0][0] != "1546300801000000000" {
+		test.Fatalf("expected entries sorted by timestamp, got %v", info.Values)
+	}
+}
+
+// Protocol buffer requests should be snappy compressed, and out-of-order
+// rejections should be permanent
+func TestLokiForwarderProtobufOutOfOrder(test *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+
+		decoded, err := snappy.Decode(nil, body.Bytes())
+		if err != nil || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			test.Errorf("expected a snappy compressed protocol buffer, got %v", err)
+		}
+
+		if !bytes.Contains(decoded, []byte(`{job="app"}`)) || !bytes.Contains(decoded, []byte("line")) {
+			test.Errorf("expected the stream labels and line in %q", decoded)
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `entry with timestamp 2019-01-01 00:00:00 +0000 UTC ignored, reason: 'entry out of order' for stream: {job="app"}`)
+	}))
+	defer server.Close()
+
+	forwarder, err := NewLokiForwarder(server.URL, LokiConfig{
+		Labels: map[string]string{"job": "app"},
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	err = forwarder.Forward(context.Background(), bytes.NewBufferString("line\n"))
+	if !IsPermanent(err) || !errors.Is(err, ErrLokiOutOfOrder) {
+		test.Fatalf("expected a permanent out-of-order error, got %v", err)
+	}
+}
+
+// Entries older than the latest accepted for their stream should be clamped,
+// and streams idle for longer than OutOfOrderWindow forgotten
+func TestLokiForwarderClampOutOfOrder(test *testing.T) {
+	forwarder, err := NewLokiForwarder("http://localhost:3100", LokiConfig{
+		LabelFields:     map[string]string{"request": "request"},
+		ClampOutOfOrder: true,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	now := time.Date(2019, 1, 1, 0, 0, 10, 0, time.UTC)
+	forwarder.accepted(forwarder.streams([]byte(`{"dt":"2019-01-01T00:00:05Z","request":"a"}`), now), now)
+
+	streams := forwarder.streams([]byte(`{"dt":"2019-01-01T00:00:01Z","request":"a"}`), now)
+	if !streams[0].entries[0].timestamp.Equal(now.Add(-5 * time.Second)) {
+		test.Fatalf("expected the entry to be clamped, got %s", streams[0].entries[0].timestamp)
+	}
+
+	// Entries that were never accepted must not move the latest timestamp
+	forwarder.streams([]byte(`{"dt":"2019-01-01T00:00:09Z","request":"a"}`), now)
+
+	streams = forwarder.streams([]byte(`{"dt":"2019-01-01T00:00:07Z","request":"a"}`), now)
+	if !streams[0].entries[0].timestamp.Equal(now.Add(-3 * time.Second)) {
+		test.Fatalf("expected the entry not to be clamped, got %s", streams[0].entries[0].timestamp)
+	}
+
+	later := now.Add(2 * time.Hour)
+	forwarder.accepted(forwarder.streams([]byte(`{"dt":"2019-01-01T02:00:00Z","request":"b"}`), later), later)
+	if len(forwarder.latest) != 1 {
+		test.Fatalf("expected the idle stream to be forgotten, got %d streams", len(forwarder.latest))
+	}
+}
+
+func TestEncodeLokiProtobuf(test *testing.T) {
+	streams := []*lokiStream{{
+		labels:  map[string]string{"a": "b"},
+		entries: []lokiEntry{{timestamp: time.Unix(1, 2), line: []byte("x")}},
+	}}
+
+	expected := []byte{
+		0x0a, 0x14, // streams
+		0x0a, 0x07, '{', 'a', '=', '"', 'b', '"', '}', // labels
+		0x12, 0x09, // entries
+		0x0a, 0x04, 0x08, 0x01, 0x10, 0x02, // timestamp
+		0x12, 0x01, 'x', // line
+	}
+
+	if encoded := encodeLokiProtobuf(streams); !bytes.Equal(encoded, expected) {
+		test.Fatalf("expected %x, got %x", expected, encoded)
+	}
+}
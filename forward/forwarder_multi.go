@@ -0,0 +1,191 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/timberio/timber-go/logging"
+)
+
+var (
+	defaultMultiQueueSize = 16
+
+	// ErrQueueFull is reported for a destination whose queue had no room for
+	// a buffer, which was dropped for that destination only. Forwarding the
+	// result's Buffer to that destination again may succeed.
+	ErrQueueFull = errors.New("MultiForwarder: destination queue is full")
+
+	errMultiForwarderClosed = errors.New("MultiForwarder: closed")
+)
+
+// Destination is a named Forwarder that a MultiForwarder sends buffers to.
+type Destination struct {
+	Name      string
+	Forwarder Forwarder
+}
+
+// DestinationResult is the outcome of forwarding a buffer to one destination.
+type DestinationResult struct {
+	Destination string
+	Result
+}
+
+// MultiForwarder sends a copy of every buffer to each of its destinations in
+// parallel. Every destination has its own queue and worker, so a slow
+// destination only delays its own deliveries.
+type MultiForwarder struct {
+	Destinations []Destination
+
+	MultiConfig
+
+	queues []chan *bytes.Buffer
+	mutex  sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type MultiConfig struct {
+	// QueueSize is the number of buffers that may wait for each destination.
+	QueueSize int
+
+	// Results, when set, receives the outcome of every buffer for every
+	// destination. Sends block, so the channel must be drained.
+	Results chan<- DestinationResult
+
+	// Logger reports failures when Results is nil.
+	Logger logging.Logger
+}
+
+func DefaultMultiConfig() MultiConfig {
+	return MultiConfig{
+		QueueSize: defaultMultiQueueSize,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+func NewMultiForwarder(destinations []Destination, config MultiConfig) *MultiForwarder {
+	defaultConfig := DefaultMultiConfig()
+
+	if config.QueueSize == 0 {
+		config.QueueSize = defaultConfig.QueueSize
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m := &MultiForwarder{
+		Destinations: destinations,
+		MultiConfig:  config,
+
+		queues: make([]chan *bytes.Buffer, len(destinations)),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	for i, destination := range destinations {
+		m.queues[i] = make(chan *bytes.Buffer, config.QueueSize)
+
+		m.wg.Add(1)
+		go m.deliver(destination, m.queues[i])
+	}
+
+	return m
+}
+
+// Forward queues a copy of buffer for every destination and returns without
+// waiting for delivery. Destinations whose queues are full drop their copy,
+// which is reported for that destination alone as a retryable ErrQueueFull
+// result. Forward only fails, with a retryable error, when no destination
+// had room for the buffer.
+func (m *MultiForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.closed {
+		return Permanent(errMultiForwarderClosed)
+	}
+
+	var dropped []string
+	for i, destination := range m.Destinations {
+		copied := bytes.NewBuffer(append([]byte(nil), buffer.Bytes()...))
+
+		select {
+		case m.queues[i] <- copied:
+		default:
+			dropped = append(dropped, destination.Name)
+			m.report(destination, NewResult(copied, ErrQueueFull))
+		}
+	}
+
+	if len(dropped) > 0 && len(dropped) == len(m.Destinations) {
+		return fmt.Errorf("MultiForwarder: dropped buffer for %s: queue is full", strings.Join(dropped, ", "))
+	}
+
+	return nil
+}
+
+// Close stops accepting buffers and waits for every queued buffer to be
+// delivered, then closes destinations that implement Closer. If ctx expires
+// first, deliveries in progress are cancelled and ctx.Err() is returned.
+func (m *MultiForwarder) Close(ctx context.Context) error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.closed = true
+
+	for _, queue := range m.queues {
+		close(queue)
+	}
+	m.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		m.cancel()
+		return ctx.Err()
+	}
+	m.cancel()
+
+	return closeDestinations(ctx, "MultiForwarder", m.Destinations)
+}
+
+func (m *MultiForwarder) deliver(destination Destination, queue chan *bytes.Buffer) {
+	defer m.wg.Done()
+
+	for buffer := range queue {
+		err := destination.Forwarder.Forward(m.ctx, buffer)
+		m.report(destination, NewResult(buffer, err))
+	}
+}
+
+func (m *MultiForwarder) report(destination Destination, result Result) {
+	if m.Results != nil {
+		m.Results <- DestinationResult{
+			Destination: destination.Name,
+			Result:      result,
+		}
+		return
+	}
+
+	if result.Err != nil {
+		m.Logger.Printf("MultiForwarder: %s %s failure: %s", destination.Name, result.Status, result.Err)
+	}
+}
@@ -0,0 +1,149 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/timberio/timber-go/logging"
+)
+
+// A slow destination should not delay delivery to the others
+func TestMultiForwarderIndependentQueues(test *testing.T) {
+	blocked := make(chan struct{})
+	slow := ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+		<-blocked
+		return nil
+	})
+
+	delivered := make(chan string, 2)
+	fast := ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+		delivered <- buffer.String()
+		return nil
+	})
+
+	multi := NewMultiForwarder([]Destination{
+		{Name: "slow", Forwarder: slow},
+		{Name: "fast", Forwarder: fast},
+	}, MultiConfig{})
+
+	for i := 0; i < 2; i++ {
+		if err := multi.Forward(context.Background(), bytes.NewBufferString("test log line\n")); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(5 * time.Second):
+			test.Fatal("expected the fast destination not to wait for the slow one")
+		}
+	}
+
+	close(blocked)
+	if err := multi.Close(context.Background()); err != nil {
+		test.Fatal(err)
+	}
+}
+
+// Every destination should report its own result
+func TestMultiForwarderResults(test *testing.T) {
+	results := make(chan DestinationResult, 3)
+
+	multi := NewMultiForwarder([]Destination{
+		{Name: "ok", Forwarder: ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+			return nil
+		})},
+		{Name: "failing", Forwarder: ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+			return errors.New("endpoint is down")
+		})},
+	}, MultiConfig{
+		Results: results,
+	})
+
+	multi.Forward(context.Background(), bytes.NewBufferString("test log line\n"))
+	multi.Close(context.Background())
+	close(results)
+
+	statuses := map[string]Status{}
+	for result := range results {
+		statuses[result.Destination] = result.Status
+	}
+
+	if statuses["ok"] != StatusSuccess || statuses["failing"] != StatusRetryable {
+		test.Fatalf("expected success for ok and retryable failure for failing, got %+v", statuses)
+	}
+}
+
+// Buffers should be dropped, and reported, for destinations with full queues
+// without failing the buffer for the destinations that accepted it
+func TestMultiForwarderQueueFull(test *testing.T) {
+	blocked := make(chan struct{})
+	results := make(chan DestinationResult, 8)
+
+	multi := NewMultiForwarder([]Destination{
+		{Name: "slow", Forwarder: ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+			<-blocked
+			return nil
+		})},
+		{Name: "fast", Forwarder: ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+			return nil
+		})},
+	}, MultiConfig{
+		QueueSize: 1,
+		Results:   results,
+	})
+
+	// The slow destination holds one buffer and queues another
+	for i := 0; i < 3; i++ {
+		if err := multi.Forward(context.Background(), bytes.NewBufferString("test log line\n")); err != nil {
+			test.Fatalf("expected the buffer to be accepted by the fast destination, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var dropped *DestinationResult
+	for dropped == nil {
+		if result := <-results; result.Err == ErrQueueFull {
+			dropped = &result
+		}
+	}
+
+	if dropped.Destination != "slow" || dropped.Status != StatusRetryable || dropped.Buffer.String() != "test log line\n" {
+		test.Fatalf("expected a retryable ErrQueueFull for the slow destination, got %+v", dropped)
+	}
+
+	close(blocked)
+	multi.Close(context.Background())
+}
+
+// Forward should fail when no destination had room for the buffer
+func TestMultiForwarderAllQueuesFull(test *testing.T) {
+	blocked := make(chan struct{})
+
+	multi := NewMultiForwarder([]Destination{
+		{Name: "slow", Forwarder: ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+			<-blocked
+			return nil
+		})},
+	}, MultiConfig{
+		QueueSize: 1,
+		Logger:    logging.DiscardingLogger,
+	})
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = multi.Forward(context.Background(), bytes.NewBufferString("test log line\n"))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err == nil || IsPermanent(err) {
+		test.Fatalf("expected a retryable error once the queue filled up, got %v", err)
+	}
+
+	close(blocked)
+	multi.Close(context.Background())
+}
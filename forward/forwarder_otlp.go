@@ -0,0 +1,472 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/timberio/timber-go/compress"
+	"github.com/timberio/timber-go/logging"
+	"github.com/timberio/timber-go/metadata"
+)
+
+var (
+	otlpLogsPath = "/v1/logs"
+
+	defaultOTLPTimestampField = "dt"
+	defaultOTLPLevelField     = "level"
+	defaultOTLPMessageField   = "message"
+	defaultOTLPTimeout        = 10 * time.Second
+)
+
+// OTLPEncoding is the body format of export requests.
+type OTLPEncoding int
+
+const (
+	// OTLPProtobuf sends protocol buffers.
+	OTLPProtobuf OTLPEncoding = iota
+	// OTLPJSON sends the JSON mapping of the protocol buffers.
+	OTLPJSON
+)
+
+// OTLP severity numbers, the first of each range defined by the OpenTelemetry
+// log data model.
+const (
+	otlpSeverityTrace = 1
+	otlpSeverityDebug = 5
+	otlpSeverityInfo  = 9
+	otlpSeverityWarn  = 13
+	otlpSeverityError = 17
+	otlpSeverityFatal = 21
+)
+
+// OTLPForwarder exports lines as OpenTelemetry log records over OTLP/HTTP, so
+// that they can be received by any OpenTelemetry collector.
+type OTLPForwarder struct {
+	HTTPClient *retryablehttp.Client
+	Endpoint   string
+
+	OTLPConfig
+
+	resource []otlpAttribute
+}
+
+type OTLPConfig struct {
+	// ServiceName is the service.name resource attribute.
+	ServiceName string
+	// Context, when set, adds its system and platform fields as resource
+	// attributes, such as host.name and host.id.
+	Context *metadata.Context
+	// ResourceAttributes are added to the resource of every export.
+	ResourceAttributes map[string]string
+
+	// TimestampField, LevelField and MessageField name the JSON fields
+	// mapped to the timestamp, severity and body of each log record. Other
+	// top level fields become log record attributes. Lines that are not JSON
+	// objects become the body of a record as they are.
+	TimestampField string
+	LevelField     string
+	MessageField   string
+
+	Encoding    OTLPEncoding
+	Compression compress.Codec
+
+	// Headers are added to every request, e.g. for authentication.
+	Headers map[string]string
+
+	Logger logging.Logger
+}
+
+func DefaultOTLPConfig() OTLPConfig {
+	return OTLPConfig{
+		ServiceName: filepath.Base(os.Args[0]),
+
+		TimestampField: defaultOTLPTimestampField,
+		LevelField:     defaultOTLPLevelField,
+		MessageField:   defaultOTLPMessageField,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+// NewOTLPForwarder creates a forwarder for the OTLP/HTTP receiver at endpoint,
+// e.g. "http://localhost:4318".
+func NewOTLPForwarder(endpoint string, config OTLPConfig) (*OTLPForwarder, error) {
+	if endpoint == "" {
+		return nil, errors.New("OTLPForwarder: endpoint required")
+	}
+
+	defaultConfig := DefaultOTLPConfig()
+
+	if config.ServiceName == "" {
+		config.ServiceName = defaultConfig.ServiceName
+	}
+
+	if config.TimestampField == "" {
+		config.TimestampField = defaultConfig.TimestampField
+	}
+
+	if config.LevelField == "" {
+		config.LevelField = defaultConfig.LevelField
+	}
+
+	if config.MessageField == "" {
+		config.MessageField = defaultConfig.MessageField
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	return &OTLPForwarder{
+		HTTPClient: newRetryableClient(defaultOTLPTimeout),
+		Endpoint:   strings.TrimSuffix(endpoint, "/") + otlpLogsPath,
+		OTLPConfig: config,
+
+		resource: otlpResource(config),
+	}, nil
+}
+
+// otlpResource collects the resource attributes, sorted by key.
+func otlpResource(config OTLPConfig) []otlpAttribute {
+	attributes := map[string]string{
+		"service.name": config.ServiceName,
+	}
+
+	if c := config.Context; c != nil {
+		if c.System != nil && c.System.Hostname != "" {
+			attributes["host.name"] = c.System.Hostname
+		}
+
+		if c.Platform != nil && c.Platform.AWSEC2 != nil {
+			ec2 := c.Platform.AWSEC2
+			attributes["cloud.provider"] = "aws"
+			attributes["cloud.platform"] = "aws_ec2"
+
+			for key, value := range map[string]string{
+				"host.id":       ec2.InstanceID,
+				"host.type":     ec2.InstanceType,
+				"host.image.id": ec2.AmiID,
+			} {
+				if value != "" {
+					attributes[key] = value
+				}
+			}
+
+			if attributes["host.name"] == "" && ec2.Hostname != "" {
+				attributes["host.name"] = ec2.Hostname
+			}
+		}
+	}
+
+	for key, value := range config.ResourceAttributes {
+		attributes[key] = value
+	}
+
+	resource := make([]otlpAttribute, 0, len(attributes))
+	for key, value := range attributes {
+		resource = append(resource, otlpAttribute{key: key, value: value})
+	}
+	sort.Slice(resource, func(i, j int) bool {
+		return resource[i].key < resource[j].key
+	})
+
+	return resource
+}
+
+// otlpAttribute holds a string, bool, int64 or float64 value.
+type otlpAttribute struct {
+	key   string
+	value interface{}
+}
+
+type otlpRecord struct {
+	timestamp    time.Time
+	severity     int
+	severityText string
+	body         string
+	attributes   []otlpAttribute
+}
+
+// Forward exports the lines of buffer in a single request.
+func (o *OTLPForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	now := time.Now()
+
+	var records []otlpRecord
+	for _, line := range bytes.Split(buffer.Bytes(), []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		records = append(records, o.record(line, now))
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	var payload []byte
+	var contentType string
+	if o.Encoding == OTLPJSON {
+		payload, contentType = o.encodeJSON(records, now), "application/json"
+	} else {
+		payload, contentType = o.encodeProtobuf(records, now), "application/x-protobuf"
+	}
+
+	if o.Compression != nil {
+		var compressed bytes.Buffer
+		if err := compress.Encode(o.Compression, &compressed, payload); err != nil {
+			return Permanent(err)
+		}
+		payload = compressed.Bytes()
+	}
+
+	req, err := retryablehttp.NewRequest("POST", o.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return Permanent(err)
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Add("Content-Type", contentType)
+	if o.Compression != nil {
+		req.Header.Add("Content-Encoding", o.Compression.Encoding())
+	}
+	for name, value := range o.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := o.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		return nil
+	}
+
+	return statusError("OTLPForwarder", resp)
+}
+
+// record maps a line to a log record.
+func (o *OTLPForwarder) record(line []byte, now time.Time) otlpRecord {
+	record := otlpRecord{timestamp: now}
+
+	trimmed := bytes.TrimSpace(line)
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	if len(trimmed) == 0 || trimmed[0] != '{' || decoder.Decode(&fields) != nil {
+		record.body = string(line)
+		return record
+	}
+
+	if value, ok := fields[o.TimestampField].(string); ok {
+		if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			record.timestamp = parsed
+			delete(fields, o.TimestampField)
+		}
+	}
+
+	if value, ok := fields[o.LevelField].(string); ok {
+		record.severityText = value
+		record.severity = otlpSeverity(value)
+		delete(fields, o.LevelField)
+	}
+
+	if value, ok := fields[o.MessageField].(string); ok {
+		record.body = value
+		delete(fields, o.MessageField)
+	} else {
+		record.body = string(trimmed)
+	}
+
+	for key, value := range fields {
+		record.attributes = append(record.attributes, otlpAttribute{key: key, value: otlpValue(value)})
+	}
+	sort.Slice(record.attributes, func(i, j int) bool {
+		return record.attributes[i].key < record.attributes[j].key
+	})
+
+	return record
+}
+
+// otlpValue converts a decoded JSON value to an attribute value. Objects,
+// arrays and null are kept as their JSON encoding.
+func otlpValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string, bool:
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+func otlpSeverity(level string) int {
+	switch strings.ToLower(level) {
+	case "trace":
+		return otlpSeverityTrace
+	case "debug":
+		return otlpSeverityDebug
+	case "info", "notice":
+		return otlpSeverityInfo
+	case "warn", "warning":
+		return otlpSeverityWarn
+	case "error", "err":
+		return otlpSeverityError
+	case "fatal", "critical", "crit", "alert", "emergency", "panic":
+		return otlpSeverityFatal
+	default:
+		return 0
+	}
+}
+
+// encodeProtobuf encodes an ExportLogsServiceRequest with a single resource
+// and scope.
+func (o *OTLPForwarder) encodeProtobuf(records []otlpRecord, now time.Time) []byte {
+	var resource, scope, scopeLogs, record []byte
+
+	for _, attribute := range o.resource {
+		resource = appendProtoBytes(resource, 1, encodeOTLPKeyValue(attribute))
+	}
+
+	scope = appendProtoString(scope, 1, "timber-go")
+	scope = appendProtoString(scope, 2, version)
+	scopeLogs = appendProtoBytes(scopeLogs, 1, scope)
+
+	for _, r := range records {
+		record = appendProtoFixed64(record[:0], 1, uint64(r.timestamp.UnixNano()))
+		if r.severity != 0 {
+			record = appendProtoVarint(record, 2, uint64(r.severity))
+		}
+		if r.severityText != "" {
+			record = appendProtoString(record, 3, r.severityText)
+		}
+		record = appendProtoBytes(record, 5, encodeOTLPAnyValue(r.body))
+		for _, attribute := range r.attributes {
+			record = appendProtoBytes(record, 6, encodeOTLPKeyValue(attribute))
+		}
+		record = appendProtoFixed64(record, 11, uint64(now.UnixNano()))
+
+		scopeLogs = appendProtoBytes(scopeLogs, 2, record)
+	}
+
+	var resourceLogs []byte
+	resourceLogs = appendProtoBytes(resourceLogs, 1, resource)
+	resourceLogs = appendProtoBytes(resourceLogs, 2, scopeLogs)
+
+	return appendProtoBytes(nil, 1, resourceLogs)
+}
+
+func encodeOTLPKeyValue(attribute otlpAttribute) []byte {
+	keyValue := appendProtoString(nil, 1, attribute.key)
+	return appendProtoBytes(keyValue, 2, encodeOTLPAnyValue(attribute.value))
+}
+
+func encodeOTLPAnyValue(value interface{}) []byte {
+	switch v := value.(type) {
+	case bool:
+		var b uint64
+		if v {
+			b = 1
+		}
+		return appendProtoVarint(nil, 2, b)
+	case int64:
+		return appendProtoVarint(nil, 3, uint64(v))
+	case float64:
+		return appendProtoFixed64(nil, 4, math.Float64bits(v))
+	default:
+		return appendProtoString(nil, 1, v.(string))
+	}
+}
+
+type otlpJSONKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpJSONRecord struct {
+	TimeUnixNano         string                 `json:"timeUnixNano"`
+	ObservedTimeUnixNano string                 `json:"observedTimeUnixNano"`
+	SeverityNumber       int                    `json:"severityNumber,omitempty"`
+	SeverityText         string                 `json:"severityText,omitempty"`
+	Body                 map[string]interface{} `json:"body"`
+	Attributes           []otlpJSONKeyValue     `json:"attributes,omitempty"`
+}
+
+// encodeJSON encodes an ExportLogsServiceRequest with the OTLP JSON mapping,
+// in which 64 bit integers are strings.
+func (o *OTLPForwarder) encodeJSON(records []otlpRecord, now time.Time) []byte {
+	observed := strconv.FormatInt(now.UnixNano(), 10)
+
+	logRecords := make([]otlpJSONRecord, len(records))
+	for i, r := range records {
+		logRecords[i] = otlpJSONRecord{
+			TimeUnixNano:         strconv.FormatInt(r.timestamp.UnixNano(), 10),
+			ObservedTimeUnixNano: observed,
+			SeverityNumber:       r.severity,
+			SeverityText:         r.severityText,
+			Body:                 otlpJSONValue(r.body),
+			Attributes:           otlpJSONAttributes(r.attributes),
+		}
+	}
+
+	request := map[string]interface{}{
+		"resourceLogs": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpJSONAttributes(o.resource),
+				},
+				"scopeLogs": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{
+							"name":    "timber-go",
+							"version": version,
+						},
+						"logRecords": logRecords,
+					},
+				},
+			},
+		},
+	}
+
+	encoded, _ := json.Marshal(request)
+	return encoded
+}
+
+func otlpJSONAttributes(attributes []otlpAttribute) []otlpJSONKeyValue {
+	keyValues := make([]otlpJSONKeyValue, len(attributes))
+	for i, attribute := range attributes {
+		keyValues[i] = otlpJSONKeyValue{Key: attribute.key, Value: otlpJSONValue(attribute.value)}
+	}
+	return keyValues
+}
+
+func otlpJSONValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": v}
+	}
+}
@@ -0,0 +1,127 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/timberio/timber-go/metadata"
+)
+
+type otlpJSONRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			LogRecords []otlpJSONRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+// Lines should map to log records, and the metadata context to resource
+// attributes
+func TestOTLPForwarderJSON(test *testing.T) {
+	requests := make(chan otlpJSONRequest, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpLogsPath || r.Header.Get("Authorization") != "Bearer token" {
+			test.Errorf("unexpected request to %s", r.URL.Path)
+		}
+
+		var request otlpJSONRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		requests <- request
+	}))
+	defer server.Close()
+
+	forwarder, err := NewOTLPForwarder(server.URL, OTLPConfig{
+		ServiceName: "api",
+		Context: &metadata.Context{
+			System: &metadata.SystemContext{Hostname: "web-1"},
+			Platform: &metadata.PlatformContext{
+				AWSEC2: &metadata.AWSEC2Context{InstanceID: "i-0123"},
+			},
+		},
+		Encoding: OTLPJSON,
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	buffer := bytes.NewBufferString(`{"dt":"2019-01-01T00:00:01Z","level":"warn","message":"slow","duration_ms":250}
+plain line
+`)
+
+	if err := forwarder.Forward(context.Background(), buffer); err != nil {
+		test.Fatal(err)
+	}
+
+	request := <-requests
+	resource := map[string]interface{}{}
+	for _, attribute := range request.ResourceLogs[0].Resource.Attributes {
+		resource[attribute.Key] = attribute.Value["stringValue"]
+	}
+
+	if resource["service.name"] != "api" || resource["host.name"] != "web-1" || resource["host.id"] != "i-0123" {
+		test.Fatalf("unexpected resource attributes %v", resource)
+	}
+
+	records := request.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(records) != 2 {
+		test.Fatalf("expected 2 log records, got %d", len(records))
+	}
+
+	warn := records[0]
+	if warn.TimeUnixNano != "1546300801000000000" || warn.SeverityNumber != otlpSeverityWarn ||
+		warn.Body["stringValue"] != "slow" {
+		test.Fatalf("unexpected log record %+v", warn)
+	}
+
+	if len(warn.Attributes) != 1 || warn.Attributes[0].Key != "duration_ms" || warn.Attributes[0].Value["intValue"] != "250" {
+		test.Fatalf("expected the remaining fields as attributes, got %+v", warn.Attributes)
+	}
+
+	if records[1].Body["stringValue"] != "plain line" {
+		test.Fatalf("expected plain lines as the body, got %+v", records[1])
+	}
+}
+
+func TestOTLPForwarderProtobuf(test *testing.T) {
+	bodies := make(chan []byte, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			test.Errorf("unexpected content type %s", r.Header.Get("Content-Type"))
+		}
+
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+		bodies <- body.Bytes()
+	}))
+	defer server.Close()
+
+	forwarder, err := NewOTLPForwarder(server.URL, OTLPConfig{ServiceName: "api"})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	if err := forwarder.Forward(context.Background(), bytes.NewBufferString("hello\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	body := <-bodies
+
+	// KeyValue{key: "service.name", value: AnyValue{string_value: "api"}}
+	serviceName := append(appendProtoString(nil, 1, "service.name"), 0x12, 0x05, 0x0a, 0x03, 'a', 'p', 'i')
+	// LogRecord body AnyValue{string_value: "hello"}
+	logBody := []byte{0x2a, 0x07, 0x0a, 0x05, 'h', 'e', 'l', 'l', 'o'}
+
+	if !bytes.Contains(body, serviceName) || !bytes.Contains(body, logBody) {
+		test.Fatalf("expected the service name and body in %x", body)
+	}
+}
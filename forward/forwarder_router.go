@@ -0,0 +1,197 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/timberio/timber-go/logging"
+)
+
+var (
+	// Name reported for the destination of lines that match no route
+	defaultRouteName = "default"
+)
+
+// Route sends the lines matching Matcher to Forwarder.
+type Route struct {
+	Name      string
+	Matcher   Matcher
+	Forwarder Forwarder
+}
+
+// RouterForwarder splits every buffer by line, dispatching each line to the
+// first route whose Matcher accepts it, so that a single batcher can feed
+// several destinations, e.g. HTTPForwarders with different API keys. Routes
+// share that batcher instead of batching separately: each route receives one
+// buffer per incoming buffer, holding its lines in order.
+type RouterForwarder struct {
+	Routes []Route
+
+	RouterConfig
+}
+
+type RouterConfig struct {
+	// Default receives the lines that match no route. When nil, they are
+	// dropped and reported as a permanent failure.
+	Default Forwarder
+
+	// Results, when set, receives the outcome of every route's buffer.
+	// Sends block, so the channel must be drained.
+	Results chan<- DestinationResult
+
+	// Logger reports failures when Results is nil.
+	Logger logging.Logger
+}
+
+func DefaultRouterConfig() RouterConfig {
+	return RouterConfig{
+		Logger: logging.DefaultLogger,
+	}
+}
+
+func NewRouterForwarder(routes []Route, config RouterConfig) *RouterForwarder {
+	if config.Logger == nil {
+		config.Logger = DefaultRouterConfig().Logger
+	}
+
+	return &RouterForwarder{
+		Routes:       routes,
+		RouterConfig: config,
+	}
+}
+
+// Forward dispatches the lines of buffer to their routes in parallel. If any
+// route fails, an error naming the failed routes is returned. When other routes
+// accepted their lines, it is a PartialError holding only the lines of routes
+// that may succeed if retried, which a retry dispatches to those routes alone.
+// It is permanent when every failure was.
+func (r *RouterForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	routed, unmatched := r.split(buffer.Bytes())
+
+	destinations := make([]Destination, 0, len(r.Routes)+1)
+	buffers := make([]*bytes.Buffer, 0, len(r.Routes)+1)
+	for i, route := range r.Routes {
+		if routed[i].Len() > 0 {
+			destinations = append(destinations, Destination{Name: route.Name, Forwarder: route.Forwarder})
+			buffers = append(buffers, routed[i])
+		}
+	}
+
+	var dropped error
+	if unmatched.Len() > 0 {
+		if r.Default != nil {
+			destinations = append(destinations, Destination{Name: defaultRouteName, Forwarder: r.Default})
+			buffers = append(buffers, unmatched)
+		} else {
+			dropped = Permanent(fmt.Errorf("RouterForwarder: dropped %d bytes matching no route", unmatched.Len()))
+			r.report(defaultRouteName, NewResult(unmatched, dropped))
+		}
+	}
+
+	errs := make([]error, len(destinations))
+	var wg sync.WaitGroup
+	for i := range destinations {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = destinations[i].Forwarder.Forward(ctx, buffers[i])
+			r.report(destinations[i].Name, NewResult(buffers[i], errs[i]))
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []string
+	var remaining bytes.Buffer
+	permanent := true
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		failed = append(failed, fmt.Sprintf("%s: %s", destinations[i].Name, err))
+		if IsPermanent(err) {
+			continue
+		}
+
+		permanent = false
+		remaining.Write(Remaining(buffers[i], err).Bytes())
+	}
+
+	if len(failed) == 0 {
+		return dropped
+	}
+
+	err := fmt.Errorf("RouterForwarder: routes failed: %s", strings.Join(failed, "; "))
+	if permanent {
+		return Permanent(err)
+	}
+
+	if remaining.Len() < buffer.Len() {
+		// Some lines were delivered, or cannot be
+		return Partial(remaining.Bytes(), err)
+	}
+
+	return err
+}
+
+// split sorts the lines of body into one buffer per route and a buffer of
+// unmatched lines.
+func (r *RouterForwarder) split(body []byte) ([]*bytes.Buffer, *bytes.Buffer) {
+	routed := make([]*bytes.Buffer, len(r.Routes))
+	for i := range routed {
+		routed[i] = &bytes.Buffer{}
+	}
+	unmatched := &bytes.Buffer{}
+
+	for len(body) > 0 {
+		end := bytes.IndexByte(body, '\n')
+		if end < 0 {
+			end = len(body) - 1
+		}
+		line := body[:end+1]
+		body = body[end+1:]
+
+		target := unmatched
+		candidate := routedLine{raw: bytes.TrimSuffix(line, []byte("\n"))}
+		for i, route := range r.Routes {
+			if candidate.match(route.Matcher) {
+				target = routed[i]
+				break
+			}
+		}
+		target.Write(line)
+	}
+
+	return routed, unmatched
+}
+
+// Close closes every route forwarder, and the default one, that implements
+// Closer.
+func (r *RouterForwarder) Close(ctx context.Context) error {
+	forwarders := make([]Destination, 0, len(r.Routes)+1)
+	for _, route := range r.Routes {
+		forwarders = append(forwarders, Destination{Name: route.Name, Forwarder: route.Forwarder})
+	}
+	if r.Default != nil {
+		forwarders = append(forwarders, Destination{Name: defaultRouteName, Forwarder: r.Default})
+	}
+
+	return closeDestinations(ctx, "RouterForwarder", forwarders)
+}
+
+func (r *RouterForwarder) report(name string, result Result) {
+	if r.Results != nil {
+		r.Results <- DestinationResult{
+			Destination: name,
+			Result:      result,
+		}
+		return
+	}
+
+	if result.Err != nil {
+		r.Logger.Printf("RouterForwarder: %s %s failure: %s", name, result.Status, result.Err)
+	}
+}
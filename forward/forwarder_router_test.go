@@ -0,0 +1,127 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+)
+
+type recordingForwarder struct {
+	buffers []string
+}
+
+func (r *recordingForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	r.buffers = append(r.buffers, buffer.String())
+	return nil
+}
+
+// Lines should be dispatched to the first matching route, and unmatched lines
+// to the default forwarder
+func TestRouterForwarder(test *testing.T) {
+	audit := &recordingForwarder{}
+	access := &recordingForwarder{}
+	app := &recordingForwarder{}
+
+	router := NewRouterForwarder([]Route{
+		{Name: "audit", Matcher: JSONFieldMatcher("context.kind", "audit"), Forwarder: audit},
+		{Name: "access", Matcher: RegexpMatcher(regexp.MustCompile(`^\S+ - - \[`)), Forwarder: access},
+	}, RouterConfig{
+		Default: app,
+	})
+
+	buffer := bytes.NewBufferString(`{"message":"login","context":{"kind":"audit"}}
+127.0.0.1 - - [06/Jun/2018:12:00:00 +0000] "GET / HTTP/1.1" 200
+{"message":"started"}
+`)
+
+	if err := router.Forward(context.Background(), buffer); err != nil {
+		test.Fatal(err)
+	}
+
+	if len(audit.buffers) != 1 || audit.buffers[0] != "{\"message\":\"login\",\"context\":{\"kind\":\"audit\"}}\n" {
+		test.Fatalf("unexpected audit buffers %+v", audit.buffers)
+	}
+
+	if len(access.buffers) != 1 || access.buffers[0][:9] != "127.0.0.1" {
+		test.Fatalf("unexpected access buffers %+v", access.buffers)
+	}
+
+	if len(app.buffers) != 1 || app.buffers[0] != "{\"message\":\"started\"}\n" {
+		test.Fatalf("unexpected default buffers %+v", app.buffers)
+	}
+}
+
+// A failing route should not prevent the others from receiving their lines,
+// and only its lines should be left for a retry
+func TestRouterForwarderPartialFailure(test *testing.T) {
+	audit := &recordingForwarder{}
+	failing := true
+
+	router := NewRouterForwarder([]Route{
+		{Name: "audit", Matcher: PrefixMatcher("AUDIT "), Forwarder: audit},
+		{Name: "app", Matcher: PrefixMatcher(""), Forwarder: ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+			if failing {
+				return errors.New("endpoint is down")
+			}
+			return nil
+		})},
+	}, RouterConfig{})
+
+	buffer := bytes.NewBufferString("AUDIT login\nstarted\n")
+	err := router.Forward(context.Background(), buffer)
+	if err == nil || IsPermanent(err) {
+		test.Fatalf("expected a retryable error after a partial failure, got %v", err)
+	}
+
+	if len(audit.buffers) != 1 {
+		test.Fatalf("expected the audit route to receive its line, got %+v", audit.buffers)
+	}
+
+	remaining := Remaining(buffer, err)
+	if remaining.String() != "started\n" {
+		test.Fatalf("expected only the failed route's line to remain, got \"%s\"", remaining)
+	}
+
+	failing = false
+	if err := router.Forward(context.Background(), remaining); err != nil {
+		test.Fatal(err)
+	}
+
+	if len(audit.buffers) != 1 {
+		test.Fatalf("expected the retry not to reach the audit route, got %+v", audit.buffers)
+	}
+}
+
+// A line should be decoded once for every JSONFieldMatcher of a router
+func TestRoutedLineDecodesOnce(test *testing.T) {
+	line := routedLine{raw: []byte(`{"level":"error","context":{"kind":"audit"}}`)}
+
+	if line.match(JSONFieldMatcher("level", "info")) {
+		test.Fatal("expected the level not to match")
+	}
+
+	// Later matchers must reuse the decoded object rather than the raw line
+	line.raw = []byte("not JSON")
+
+	if !line.match(JSONFieldMatcher("context.kind", "audit")) {
+		test.Fatal("expected the decoded line to be reused")
+	}
+}
+
+func TestJSONFieldMatcher(test *testing.T) {
+	matcher := JSONFieldMatcher("level", "error")
+
+	if !matcher.Match([]byte(`{"level":"error","message":"failed"}`)) {
+		test.Fatal("expected JSON line with matching field to match")
+	}
+
+	if matcher.Match([]byte(`{"level":"info"}`)) || matcher.Match([]byte(`level=error`)) {
+		test.Fatal("expected non-matching and non-JSON lines not to match")
+	}
+
+	if !JSONFieldMatcher("status", "500").Match([]byte(`{"status":500}`)) {
+		test.Fatal("expected numeric fields to match their JSON encoding")
+	}
+}
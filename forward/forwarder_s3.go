@@ -0,0 +1,621 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/timberio/timber-go/compress"
+	"github.com/timberio/timber-go/logging"
+	"github.com/timberio/timber-go/metadata"
+)
+
+var (
+	defaultS3Region             = "us-east-1"
+	defaultS3KeyPrefix          = "{host}/{2006/01/02/15}/"
+	defaultS3MaxObjectSize      = 64 * 1024 * 1024
+	defaultS3FlushInterval      = 5 * time.Minute
+	defaultS3MultipartThreshold = 16 * 1024 * 1024
+	defaultS3PartSize           = 8 * 1024 * 1024
+	defaultS3MaxPendingObjects  = 4
+	defaultS3RetryInterval      = 10 * time.Second
+	defaultS3Timeout            = 5 * time.Minute
+
+	// Smallest part S3 accepts, other than the last
+	minS3PartSize = 5 * 1024 * 1024
+
+	s3Service          = "s3"
+	s3KeyTemplate      = regexp.MustCompile(`\{([^}]*)\}`)
+	s3ObjectTimeFormat = "20060102T150405Z"
+
+	// ErrS3Backlog is returned by Forward when MaxPendingObjects objects are
+	// already waiting to be uploaded. The buffer was not accepted.
+	ErrS3Backlog = errors.New("S3Forwarder: upload backlog is full")
+
+	errS3ForwarderClosed = errors.New("S3Forwarder: closed")
+)
+
+// S3Forwarder archives buffers to S3 or S3-compatible object storage such as
+// MinIO. Buffers are compressed into a single object until it reaches
+// MaxObjectSize or has been open for FlushInterval, and objects are uploaded
+// in the background, retrying until they succeed or fail permanently.
+type S3Forwarder struct {
+	HTTPClient *retryablehttp.Client
+	Endpoint   string
+	Bucket     string
+
+	S3Config
+
+	credentials *awsCredentialsProvider
+
+	mutex   sync.Mutex
+	current *s3Object
+	closed  bool
+
+	uploads chan *s3Object
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+type S3Config struct {
+	Region string
+	// Credentials sign every request. When empty, they are read from the
+	// environment, and failing that fetched from the instance profile
+	// through EC2Client and refreshed before they expire.
+	Credentials AWSCredentials
+	EC2Client   *metadata.EC2Client
+
+	// KeyPrefix is the prefix of every object key. {host} is replaced with
+	// Host, and Go time layouts in braces with the UTC time the object was
+	// started, e.g. "{host}/{2006/01/02/15}/". Object names are made of that
+	// time and a random suffix.
+	KeyPrefix string
+	Host      string
+
+	// Compression compresses objects, gzip by default. Uncompressed disables
+	// it.
+	Compression  compress.Codec
+	Uncompressed bool
+
+	// MaxObjectSize is the number of uncompressed bytes after which an
+	// object is uploaded. FlushInterval uploads objects that have been open
+	// for that long, however small.
+	MaxObjectSize int
+	FlushInterval time.Duration
+
+	// Objects larger than MultipartThreshold are uploaded in parts of
+	// PartSize bytes.
+	MultipartThreshold int
+	PartSize           int
+
+	// MaxPendingObjects bounds the objects waiting to be uploaded, and so the
+	// memory used while storage is unavailable.
+	MaxPendingObjects int
+	// RetryInterval is how long to wait after a failed upload before trying
+	// again.
+	RetryInterval time.Duration
+
+	// Results, when set, receives the outcome of every upload attempt. The
+	// Buffer of results is nil. Sends block, so the channel must be drained.
+	Results chan<- Result
+
+	Logger logging.Logger
+}
+
+func DefaultS3Config() S3Config {
+	hostname, _ := os.Hostname()
+
+	return S3Config{
+		Region:      defaultS3Region,
+		Credentials: AWSCredentialsFromEnv(),
+
+		KeyPrefix: defaultS3KeyPrefix,
+		Host:      hostname,
+
+		Compression: compress.Gzip,
+
+		MaxObjectSize: defaultS3MaxObjectSize,
+		FlushInterval: defaultS3FlushInterval,
+
+		MultipartThreshold: defaultS3MultipartThreshold,
+		PartSize:           defaultS3PartSize,
+
+		MaxPendingObjects: defaultS3MaxPendingObjects,
+		RetryInterval:     defaultS3RetryInterval,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+// NewS3Forwarder creates a forwarder that archives to bucket at endpoint, e.g.
+// "https://s3.us-east-1.amazonaws.com" or "http://localhost:9000" for MinIO.
+// Objects are addressed path-style, as endpoint/bucket/key.
+func NewS3Forwarder(endpoint string, bucket string, config S3Config) (*S3Forwarder, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("S3Forwarder: endpoint and bucket required")
+	}
+
+	defaultConfig := DefaultS3Config()
+
+	if config.Region == "" {
+		config.Region = defaultConfig.Region
+	}
+
+	if config.Credentials.empty() {
+		config.Credentials = defaultConfig.Credentials
+	}
+
+	if config.Credentials.empty() && config.EC2Client == nil {
+		config.EC2Client = metadata.NewEC2Client(metadata.DefaultConfig())
+	}
+
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = defaultConfig.KeyPrefix
+	}
+
+	if config.Host == "" {
+		config.Host = defaultConfig.Host
+	}
+
+	if config.Compression == nil {
+		config.Compression = defaultConfig.Compression
+	}
+
+	if config.Uncompressed {
+		config.Compression = nil
+	}
+
+	if config.MaxObjectSize == 0 {
+		config.MaxObjectSize = defaultConfig.MaxObjectSize
+	}
+
+	if config.FlushInterval == 0 {
+		config.FlushInterval = defaultConfig.FlushInterval
+	}
+
+	if config.MultipartThreshold == 0 {
+		config.MultipartThreshold = defaultConfig.MultipartThreshold
+	}
+
+	if config.PartSize == 0 {
+		config.PartSize = defaultConfig.PartSize
+	}
+
+	if config.PartSize < minS3PartSize {
+		return nil, fmt.Errorf("S3Forwarder: part size must be at least %d bytes", minS3PartSize)
+	}
+
+	if config.MaxPendingObjects == 0 {
+		config.MaxPendingObjects = defaultConfig.MaxPendingObjects
+	}
+
+	if config.RetryInterval == 0 {
+		config.RetryInterval = defaultConfig.RetryInterval
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &S3Forwarder{
+		HTTPClient: newRetryableClient(defaultS3Timeout),
+		Endpoint:   strings.TrimSuffix(endpoint, "/"),
+		Bucket:     bucket,
+		S3Config:   config,
+
+		credentials: newAWSCredentialsProvider(config.Credentials, config.EC2Client),
+
+		uploads: make(chan *s3Object, config.MaxPendingObjects),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	go s.upload()
+
+	return s, nil
+}
+
+// s3Object is an object being accumulated or waiting to be uploaded.
+type s3Object struct {
+	key     string
+	data    bytes.Buffer
+	writer  compress.Writer
+	rawSize int
+}
+
+// Forward appends buffer to the current object, which is queued for upload
+// once it reaches MaxObjectSize. It returns ErrS3Backlog without accepting
+// the buffer if too many objects are waiting to be uploaded.
+func (s *S3Forwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	if buffer.Len() == 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return Permanent(errS3ForwarderClosed)
+	}
+
+	if len(s.uploads) == cap(s.uploads) {
+		return ErrS3Backlog
+	}
+
+	if s.current == nil {
+		object, err := s.newObject(time.Now())
+		if err != nil {
+			return err
+		}
+		s.current = object
+
+		// Upload the object after FlushInterval even if no more buffers arrive
+		time.AfterFunc(s.FlushInterval, func() {
+			s.flushObject(object)
+		})
+	}
+
+	if s.current.writer != nil {
+		_, err := s.current.writer.Write(buffer.Bytes())
+		if err != nil {
+			return Permanent(err)
+		}
+	} else {
+		s.current.data.Write(buffer.Bytes())
+	}
+	s.current.rawSize += buffer.Len()
+
+	if s.current.rawSize >= s.MaxObjectSize {
+		return s.seal()
+	}
+
+	return nil
+}
+
+func (s *S3Forwarder) newObject(now time.Time) (*s3Object, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	now = now.UTC()
+	prefix := s3KeyTemplate.ReplaceAllStringFunc(s.KeyPrefix, func(match string) string {
+		inner := match[1 : len(match)-1]
+		if inner == "host" {
+			return s.Host
+		}
+		return now.Format(inner)
+	})
+
+	object := &s3Object{
+		key: prefix + now.Format(s3ObjectTimeFormat) + "-" + hex.EncodeToString(suffix) + ".log",
+	}
+
+	if s.Compression != nil {
+		writer, err := s.Compression.NewWriter(&object.data)
+		if err != nil {
+			return nil, err
+		}
+		object.writer = writer
+		object.key += s3Extension(s.Compression)
+	}
+
+	return object, nil
+}
+
+func s3Extension(codec compress.Codec) string {
+	switch codec.Encoding() {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	default:
+		return "." + codec.Encoding()
+	}
+}
+
+// flushObject queues object for upload if it is still the current object,
+// trying again later if the backlog is full.
+func (s *S3Forwarder) flushObject(object *s3Object) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.current != object || s.closed {
+		return
+	}
+
+	if len(s.uploads) == cap(s.uploads) {
+		time.AfterFunc(s.RetryInterval, func() {
+			s.flushObject(object)
+		})
+		return
+	}
+
+	if err := s.seal(); err != nil {
+		s.Logger.Printf("S3Forwarder: could not finish %s: %s", object.key, err)
+	}
+}
+
+// seal finishes the current object and queues it for upload. The caller must
+// hold s.mutex and check that the queue has room.
+func (s *S3Forwarder) seal() error {
+	object := s.current
+	s.current = nil
+
+	if err := object.finish(); err != nil {
+		return Permanent(err)
+	}
+
+	s.uploads <- object
+	return nil
+}
+
+func (o *s3Object) finish() error {
+	if o.writer == nil {
+		return nil
+	}
+	return o.writer.Close()
+}
+
+// Flush queues the current object for upload without waiting for it to fill.
+func (s *S3Forwarder) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || s.current == nil {
+		return nil
+	}
+
+	if len(s.uploads) == cap(s.uploads) {
+		return ErrS3Backlog
+	}
+
+	return s.seal()
+}
+
+// Close uploads the current object and waits for every queued object to be
+// uploaded. If ctx expires first, uploads in progress are cancelled and
+// ctx.Err() is returned; objects not yet uploaded are lost.
+func (s *S3Forwarder) Close(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+
+	object := s.current
+	s.current = nil
+	s.mutex.Unlock()
+
+	var err error
+	queued := true
+	if object != nil {
+		if err = object.finish(); err == nil {
+			select {
+			case s.uploads <- object:
+			case <-ctx.Done():
+				queued = false
+			}
+		}
+	}
+
+	// Nothing is queued once closed, and the uploader stops when the queue
+	// is closed and empty
+	close(s.uploads)
+
+	if !queued {
+		s.cancel()
+		return ctx.Err()
+	}
+
+	select {
+	case <-s.done:
+		return err
+	case <-ctx.Done():
+		s.cancel()
+		return ctx.Err()
+	}
+}
+
+func (s *S3Forwarder) upload() {
+	defer close(s.done)
+
+	for object := range s.uploads {
+		for {
+			err := s.put(s.ctx, object)
+			if s.ctx.Err() != nil {
+				return
+			}
+
+			result := NewResult(nil, err)
+			if s.Results != nil {
+				s.Results <- result
+			}
+
+			if result.Status == StatusSuccess {
+				break
+			}
+
+			if result.Status == StatusPermanent {
+				s.Logger.Printf("S3Forwarder: discarding %s after permanent failure: %s", object.key, err)
+				break
+			}
+
+			s.Logger.Printf("S3Forwarder: could not upload %s, retrying in %s: %s", object.key, s.RetryInterval, err)
+			if sleep(s.ctx, s.RetryInterval) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *S3Forwarder) put(ctx context.Context, object *s3Object) error {
+	body := object.data.Bytes()
+
+	if len(body) > s.MultipartThreshold {
+		return s.putMultipart(ctx, object.key, body)
+	}
+
+	_, err := s.request(ctx, "PUT", object.key, nil, body)
+	return err
+}
+
+// putMultipart uploads body in parts of PartSize bytes, aborting the upload
+// if any part fails.
+func (s *S3Forwarder) putMultipart(ctx context.Context, key string, body []byte) error {
+	resp, err := s.request(ctx, "POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiated); err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("S3Forwarder: could not start multipart upload of %s: %s", key, resp)
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+
+	for offset, number := 0, 1; offset < len(body); offset, number = offset+s.PartSize, number+1 {
+		end := offset + s.PartSize
+		if end > len(body) {
+			end = len(body)
+		}
+
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {initiated.UploadID},
+		}
+
+		var etag string
+		_, err := s.requestWithHeaders(ctx, "PUT", key, query, body[offset:end], func(header http.Header) {
+			etag = header.Get("ETag")
+		})
+		if err != nil {
+			s.abortMultipart(key, initiated.UploadID)
+			return err
+		}
+
+		complete.Parts = append(complete.Parts, part{PartNumber: number, ETag: etag})
+	}
+
+	completeBody, _ := xml.Marshal(complete)
+	_, err = s.request(ctx, "POST", key, url.Values{"uploadId": {initiated.UploadID}}, completeBody)
+	if err != nil {
+		s.abortMultipart(key, initiated.UploadID)
+	}
+
+	return err
+}
+
+func (s *S3Forwarder) abortMultipart(key string, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := s.request(ctx, "DELETE", key, url.Values{"uploadId": {uploadID}}, nil); err != nil {
+		s.Logger.Printf("S3Forwarder: could not abort multipart upload of %s: %s", key, err)
+	}
+}
+
+func (s *S3Forwarder) request(ctx context.Context, method string, key string, query url.Values, body []byte) ([]byte, error) {
+	return s.requestWithHeaders(ctx, method, key, query, body, nil)
+}
+
+// requestWithHeaders sends a signed request for key, returning the response
+// body and passing the response headers to onHeaders if set.
+func (s *S3Forwarder) requestWithHeaders(ctx context.Context, method string, key string, query url.Values, body []byte, onHeaders func(http.Header)) ([]byte, error) {
+	target := s.Endpoint + "/" + s.Bucket + "/" + awsURIEncode(key, false)
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := retryablehttp.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	req = req.WithContext(ctx)
+
+	if method == "PUT" && query.Get("partNumber") == "" {
+		req.Header.Set("Content-Type", s3ContentType(s.Compression))
+	}
+
+	credentials, err := s.credentials.get()
+	if err != nil {
+		return nil, fmt.Errorf("S3Forwarder: %s", err)
+	}
+
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signAWSRequest(req.Request, payloadHash, credentials, s.Region, s3Service, time.Now())
+
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return nil, s3StatusError(resp)
+	}
+
+	if onHeaders != nil {
+		onHeaders(resp.Header)
+	}
+
+	var response bytes.Buffer
+	_, err = response.ReadFrom(resp.Body)
+	return response.Bytes(), err
+}
+
+func s3ContentType(codec compress.Codec) string {
+	if codec == nil {
+		return "text/plain"
+	}
+	return "application/" + codec.Encoding()
+}
+
+// s3StatusError reports an error response like statusError, except that
+// authentication failures and expired tokens are retryable: they are fixed by
+// refreshed or rotated credentials, and retrying keeps the object until then.
+func s3StatusError(resp *http.Response) error {
+	snippet := responseSnippet(resp.Body)
+	err := fmt.Errorf("S3Forwarder: unexpected response (status code %d): %s", resp.StatusCode, snippet)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return err
+	case strings.Contains(snippet, "<Code>ExpiredToken</Code>") || strings.Contains(snippet, "<Code>TokenRefreshRequired</Code>"):
+		return err
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout:
+		return Permanent(err)
+	}
+
+	return err
+}
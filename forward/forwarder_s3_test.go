@@ -0,0 +1,190 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timberio/timber-go/logging"
+)
+
+var testAWSCredentials = AWSCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+// Buffers should be combined into a single compressed object under the key
+// prefix, uploaded when the forwarder is closed
+func TestS3Forwarder(test *testing.T) {
+	var mutex sync.Mutex
+	objects := map[string][]byte{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+			test.Errorf("unexpected %s request with authorization %q", r.Method, r.Header.Get("Authorization"))
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+			test.Errorf("unexpected payload hash for %s", r.URL.Path)
+		}
+
+		mutex.Lock()
+		objects[r.URL.Path] = body
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	forwarder, err := NewS3Forwarder(server.URL, "logs", S3Config{
+		Credentials: testAWSCredentials,
+		KeyPrefix:   "{host}/{2006}/",
+		Host:        "web-1",
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	forwarder.Forward(context.Background(), bytes.NewBufferString("first\n"))
+	forwarder.Forward(context.Background(), bytes.NewBufferString("second\n"))
+
+	if err := forwarder.Close(context.Background()); err != nil {
+		test.Fatal(err)
+	}
+
+	if len(objects) != 1 {
+		test.Fatalf("expected 1 object, got %d", len(objects))
+	}
+
+	for key, body := range objects {
+		prefix := "/logs/web-1/" + time.Now().UTC().Format("2006") + "/"
+		if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, ".log.gz") {
+			test.Fatalf("expected a key like %s*.log.gz, got %s", prefix, key)
+		}
+
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		data, _ := ioutil.ReadAll(reader)
+		if string(data) != "first\nsecond\n" {
+			test.Fatalf("unexpected object contents %q", data)
+		}
+	}
+}
+
+// Objects above the multipart threshold should be uploaded in parts
+func TestS3ForwarderMultipart(test *testing.T) {
+	var mutex sync.Mutex
+	parts := map[string][]byte{}
+	var completed []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch {
+		case r.Method == "POST" && query["uploads"] != nil:
+			io.WriteString(w, `<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == "PUT" && query.Get("uploadId") == "upload-1":
+			parts[query.Get("partNumber")] = body
+			w.Header().Set("ETag", `"etag-`+query.Get("partNumber")+`"`)
+		case r.Method == "POST" && query.Get("uploadId") == "upload-1":
+			var complete struct {
+				Parts []struct {
+					PartNumber string
+					ETag       string
+				} `xml:"Part"`
+			}
+			xml.Unmarshal(body, &complete)
+			for _, part := range complete.Parts {
+				completed = append(completed, part.PartNumber+"="+part.ETag)
+			}
+		default:
+			test.Errorf("unexpected %s request to %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	forwarder, err := NewS3Forwarder(server.URL, "logs", S3Config{
+		Credentials:        testAWSCredentials,
+		Uncompressed:       true,
+		MultipartThreshold: 1024,
+		PartSize:           minS3PartSize,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcde\n"), (minS3PartSize+1024)/16)
+	forwarder.Forward(context.Background(), bytes.NewBuffer(data))
+
+	if err := forwarder.Close(context.Background()); err != nil {
+		test.Fatal(err)
+	}
+
+	if len(parts) != 2 || len(parts["1"]) != minS3PartSize || len(parts["2"]) != len(data)-minS3PartSize {
+		test.Fatalf("expected 2 parts, got %d", len(parts))
+	}
+
+	if strings.Join(completed, ",") != `1="etag-1",2="etag-2"` {
+		test.Fatalf("unexpected parts in completion %v", completed)
+	}
+}
+
+// Authentication failures should be retried, since refreshed credentials may
+// fix them
+func TestS3ForwarderRetriesForbidden(test *testing.T) {
+	var mutex sync.Mutex
+	attempts := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<Error><Code>InvalidAccessKeyId</Code></Error>`)
+		}
+	}))
+	defer server.Close()
+
+	results := make(chan Result, 2)
+	forwarder, err := NewS3Forwarder(server.URL, "logs", S3Config{
+		Credentials:   testAWSCredentials,
+		RetryInterval: time.Millisecond,
+		Results:       results,
+		Logger:        logging.DiscardingLogger,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	forwarder.Forward(context.Background(), bytes.NewBufferString("first\n"))
+
+	if err := forwarder.Close(context.Background()); err != nil {
+		test.Fatal(err)
+	}
+
+	if status := (<-results).Status; status != StatusRetryable {
+		test.Fatalf("expected the forbidden upload to be retryable, got status %v", status)
+	}
+
+	if status := (<-results).Status; status != StatusSuccess {
+		test.Fatalf("expected the retried upload to succeed, got status %v", status)
+	}
+}
@@ -0,0 +1,158 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/timberio/timber-go/logging"
+)
+
+var (
+	defaultSocketKeepAlive    = 30 * time.Second
+	defaultSocketDialTimeout  = 10 * time.Second
+	defaultSocketWriteTimeout = 10 * time.Second
+)
+
+// SocketForwarder writes every buffer to a persistent TCP or Unix domain
+// socket connection, such as a local collector. The connection is opened on
+// the first Forward and reopened with jittered backoff after it fails.
+type SocketForwarder struct {
+	Network string
+	Address string
+
+	SocketConfig
+
+	conn *reconnectingConn
+}
+
+type SocketConfig struct {
+	// TLSConfig, when set, wraps the connection in TLS.
+	TLSConfig *tls.Config
+
+	// KeepAlive is the TCP keepalive period. A negative value disables
+	// keepalives.
+	KeepAlive    time.Duration
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MinBackoff and MaxBackoff bound the wait between failed connection
+	// attempts, which doubles with every consecutive failure.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	Logger logging.Logger
+}
+
+func DefaultSocketConfig() SocketConfig {
+	return SocketConfig{
+		KeepAlive:    defaultSocketKeepAlive,
+		DialTimeout:  defaultSocketDialTimeout,
+		WriteTimeout: defaultSocketWriteTimeout,
+
+		MinBackoff: defaultMinBackoff,
+		MaxBackoff: defaultMaxBackoff,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+// NewTCPForwarder creates a SocketForwarder that connects to a TCP address,
+// such as "localhost:5170".
+func NewTCPForwarder(address string, config SocketConfig) *SocketForwarder {
+	return newSocketForwarder("tcp", address, config)
+}
+
+// NewUnixForwarder creates a SocketForwarder that connects to the Unix domain
+// socket at path.
+func NewUnixForwarder(path string, config SocketConfig) *SocketForwarder {
+	return newSocketForwarder("unix", path, config)
+}
+
+func newSocketForwarder(network string, address string, config SocketConfig) *SocketForwarder {
+	defaultConfig := DefaultSocketConfig()
+
+	if config.KeepAlive == 0 {
+		config.KeepAlive = defaultConfig.KeepAlive
+	}
+
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultConfig.DialTimeout
+	}
+
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = defaultConfig.WriteTimeout
+	}
+
+	if config.MinBackoff == 0 {
+		config.MinBackoff = defaultConfig.MinBackoff
+	}
+
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaultConfig.MaxBackoff
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	s := &SocketForwarder{
+		Network:      network,
+		Address:      address,
+		SocketConfig: config,
+	}
+
+	s.conn = newReconnectingConn(s.dial, config.WriteTimeout, config.MinBackoff, config.MaxBackoff)
+
+	return s
+}
+
+func (s *SocketForwarder) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   s.DialTimeout,
+		KeepAlive: s.KeepAlive,
+	}
+
+	if s.TLSConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: s.TLSConfig}
+		return tlsDialer.DialContext(ctx, s.Network, s.Address)
+	}
+
+	return dialer.DialContext(ctx, s.Network, s.Address)
+}
+
+// Forward writes buffer to the connection. If the connection fails part way
+// through, the returned error wraps a *PartialWriteError recording how much of
+// the buffer was sent, in a PartialError holding the lines that were not
+// completely written once any line was.
+func (s *SocketForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	if buffer.Len() == 0 {
+		return nil
+	}
+
+	body := buffer.Bytes()
+	_, err := s.conn.write(ctx, body)
+
+	var partial *PartialWriteError
+	if !errors.As(err, &partial) {
+		return err
+	}
+
+	s.Logger.Printf("SocketForwarder: %s %s connection failed after %d of %d bytes: %s",
+		s.Network, s.Address, partial.Written, partial.Total, partial.Err)
+
+	// The line cut short is sent again in full
+	if resend := bytes.LastIndexByte(body[:partial.Written], '\n') + 1; resend > 0 {
+		return Partial(body[resend:], err)
+	}
+
+	return err
+}
+
+// Close closes the connection. Forward returns an error once closed.
+func (s *SocketForwarder) Close(ctx context.Context) error {
+	return s.conn.close()
+}
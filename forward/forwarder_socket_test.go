@@ -0,0 +1,161 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/timberio/timber-go/logging"
+)
+
+// Buffers should be written unchanged to a Unix domain socket
+func TestUnixForwarder(test *testing.T) {
+	dir, err := ioutil.TempDir("", "timber-socket")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "collector.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+
+	forwarder := NewUnixForwarder(path, SocketConfig{})
+
+	for _, line := range []string{"first\n", "second\n"} {
+		if err := forwarder.Forward(context.Background(), bytes.NewBufferString(line)); err != nil {
+			test.Fatal(err)
+		}
+	}
+	forwarder.Close(context.Background())
+
+	select {
+	case data := <-received:
+		if string(data) != "first\nsecond\n" {
+			test.Fatalf("expected both buffers, got \"%s\"", data)
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatal("expected to receive buffers")
+	}
+}
+
+// Failed connection attempts should back off, and Close should interrupt a
+// Forward waiting to reconnect
+func TestTCPForwarderBackoff(test *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	forwarder := NewTCPForwarder(address, SocketConfig{
+		MinBackoff: time.Hour,
+		MaxBackoff: time.Hour,
+	})
+
+	err = forwarder.Forward(context.Background(), bytes.NewBufferString("line\n"))
+	if err == nil || IsPermanent(err) {
+		test.Fatalf("expected a retryable dial error, got %v", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- forwarder.Forward(context.Background(), bytes.NewBufferString("line\n"))
+	}()
+
+	select {
+	case err := <-errs:
+		test.Fatalf("expected Forward to wait before reconnecting, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	forwarder.Close(context.Background())
+
+	select {
+	case err := <-errs:
+		if !IsPermanent(err) {
+			test.Fatalf("expected a permanent error after Close, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatal("expected Close to interrupt Forward")
+	}
+}
+
+type halfConn struct {
+	net.Conn
+}
+
+func (c halfConn) Write(p []byte) (int, error) {
+	return len(p) / 2, errors.New("connection reset")
+}
+
+func (c halfConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c halfConn) Close() error {
+	return nil
+}
+
+// A connection failing part way through a buffer should be reported
+func TestPartialWrite(test *testing.T) {
+	conn := newReconnectingConn(func(ctx context.Context) (net.Conn, error) {
+		return halfConn{}, nil
+	}, 0, time.Millisecond, time.Millisecond)
+
+	_, err := conn.write(context.Background(), []byte("0123456789"))
+
+	var partial *PartialWriteError
+	if !errors.As(err, &partial) {
+		test.Fatalf("expected a PartialWriteError, got %v", err)
+	}
+
+	if partial.Written != 5 || partial.Total != 10 || IsPermanent(err) {
+		test.Fatalf("unexpected partial write %+v", partial)
+	}
+}
+
+// After a partial write, only the lines that were not completely written
+// should be left for a retry
+func TestSocketForwarderPartialWrite(test *testing.T) {
+	forwarder := NewTCPForwarder("127.0.0.1:0", SocketConfig{
+		Logger: logging.DiscardingLogger,
+	})
+	forwarder.conn = newReconnectingConn(func(ctx context.Context) (net.Conn, error) {
+		return halfConn{}, nil
+	}, 0, time.Millisecond, time.Millisecond)
+
+	buffer := bytes.NewBufferString("first\nsecond\nthird\n")
+	err := forwarder.Forward(context.Background(), buffer)
+
+	var partial *PartialWriteError
+	if !errors.As(err, &partial) || IsPermanent(err) {
+		test.Fatalf("expected a retryable PartialWriteError, got %v", err)
+	}
+
+	if remaining := Remaining(buffer, err).String(); remaining != "second\nthird\n" {
+		test.Fatalf("expected the line cut short and those after it to remain, got \"%s\"", remaining)
+	}
+}
@@ -0,0 +1,358 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/timberio/timber-go/compress"
+	"github.com/timberio/timber-go/logging"
+	"github.com/timberio/timber-go/metadata"
+)
+
+var (
+	splunkEventPath = "/services/collector/event"
+	splunkAckPath   = "/services/collector/ack"
+
+	defaultSplunkTimestampField  = "dt"
+	defaultSplunkAckPollInterval = time.Second
+	defaultSplunkAckTimeout      = time.Minute
+	defaultSplunkTimeout         = 30 * time.Second
+
+	// HEC rejects larger requests with its default max_content_length
+	defaultSplunkMaxContentLength = 1000000
+
+	// ErrSplunkAckTimeout is wrapped in the permanent error returned when
+	// events are not acknowledged within AckTimeout. They were accepted and
+	// may still be indexed, so sending them again could duplicate them.
+	ErrSplunkAckTimeout = errors.New("SplunkForwarder: events not acknowledged")
+)
+
+// SplunkForwarder sends every line of a buffer as an event to the Splunk HTTP
+// Event Collector (HEC).
+type SplunkForwarder struct {
+	HTTPClient *retryablehttp.Client
+	Endpoint   string
+	Token      string
+
+	SplunkConfig
+}
+
+type SplunkConfig struct {
+	// Source, SourceType and Index set the metadata of every event. Empty
+	// fields fall back to the defaults of the HEC token.
+	Source     string
+	SourceType string
+	Index      string
+	// Host sets the host of every event. When empty, the hostname of
+	// LogEvent's system context is used.
+	Host     string
+	LogEvent *metadata.LogEvent
+
+	// TimestampField is the JSON field holding a line's RFC 3339 timestamp,
+	// sent as the event time. Lines without one are timed by Splunk.
+	TimestampField string
+
+	// MaxContentLength bounds the uncompressed size of each request. Buffers
+	// are sent in as many requests as needed, and an event larger than it is
+	// sent on its own.
+	MaxContentLength int
+
+	// Acknowledgement waits for every request to be indexed, polling its ack
+	// ID every AckPollInterval for up to AckTimeout. The token must have
+	// indexer acknowledgement enabled.
+	Acknowledgement bool
+	// Channel identifies this client to HEC. A random channel is used when
+	// empty.
+	Channel         string
+	AckPollInterval time.Duration
+	AckTimeout      time.Duration
+
+	Compression compress.Codec
+
+	Logger logging.Logger
+}
+
+func DefaultSplunkConfig() SplunkConfig {
+	return SplunkConfig{
+		TimestampField: defaultSplunkTimestampField,
+
+		MaxContentLength: defaultSplunkMaxContentLength,
+
+		AckPollInterval: defaultSplunkAckPollInterval,
+		AckTimeout:      defaultSplunkAckTimeout,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+// NewSplunkForwarder creates a forwarder for the HEC at endpoint, e.g.
+// "https://splunk.example.com:8088", authenticating with token.
+func NewSplunkForwarder(endpoint string, token string, config SplunkConfig) (*SplunkForwarder, error) {
+	if endpoint == "" {
+		return nil, errors.New("SplunkForwarder: endpoint required")
+	}
+
+	if token == "" {
+		return nil, errors.New("SplunkForwarder: token required")
+	}
+
+	defaultConfig := DefaultSplunkConfig()
+
+	if config.Host == "" && config.LogEvent != nil && config.LogEvent.Context != nil && config.LogEvent.Context.System != nil {
+		config.Host = config.LogEvent.Context.System.Hostname
+	}
+
+	if config.TimestampField == "" {
+		config.TimestampField = defaultConfig.TimestampField
+	}
+
+	if config.MaxContentLength == 0 {
+		config.MaxContentLength = defaultConfig.MaxContentLength
+	}
+
+	if config.Channel == "" {
+		channel, err := newSplunkChannel()
+		if err != nil {
+			return nil, err
+		}
+		config.Channel = channel
+	}
+
+	if config.AckPollInterval == 0 {
+		config.AckPollInterval = defaultConfig.AckPollInterval
+	}
+
+	if config.AckTimeout == 0 {
+		config.AckTimeout = defaultConfig.AckTimeout
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	return &SplunkForwarder{
+		HTTPClient:   newRetryableClient(defaultSplunkTimeout),
+		Endpoint:     strings.TrimSuffix(endpoint, "/"),
+		Token:        token,
+		SplunkConfig: config,
+	}, nil
+}
+
+// newSplunkChannel returns a random (version 4) UUID.
+func newSplunkChannel() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+type splunkEvent struct {
+	Time       json.RawMessage `json:"time,omitempty"`
+	Host       string          `json:"host,omitempty"`
+	Source     string          `json:"source,omitempty"`
+	SourceType string          `json:"sourcetype,omitempty"`
+	Index      string          `json:"index,omitempty"`
+	Event      json.RawMessage `json:"event"`
+}
+
+type splunkResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+// Forward sends the lines of buffer in requests of up to MaxContentLength
+// bytes. JSON lines are sent as structured events and other lines as strings.
+// With Acknowledgement, it returns once the events are indexed, or an error
+// wrapping ErrSplunkAckTimeout if they are not indexed within AckTimeout. A
+// failure after the first request returns a PartialError holding the lines
+// that were not sent.
+func (s *SplunkForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	var event, request bytes.Buffer
+	encoder := json.NewEncoder(&event)
+	encoder.SetEscapeHTML(false)
+
+	body := buffer.Bytes()
+	sent := false
+	// Offset in body of the first line in request
+	requestStart := 0
+
+	send := func() error {
+		if err := s.send(ctx, request.Bytes()); err != nil {
+			if sent {
+				return Partial(body[requestStart:], err)
+			}
+			return err
+		}
+		sent = true
+		request.Reset()
+		return nil
+	}
+
+	for offset := 0; offset < len(body); {
+		line := body[offset:]
+		if end := bytes.IndexByte(line, '\n'); end >= 0 {
+			line = line[:end]
+		}
+		start := offset
+		offset += len(line) + 1
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		event.Reset()
+		if err := encoder.Encode(s.event(line)); err != nil {
+			return Permanent(err)
+		}
+
+		if request.Len() > 0 && request.Len()+event.Len() > s.MaxContentLength {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+
+		if request.Len() == 0 {
+			requestStart = start
+		}
+		request.Write(event.Bytes())
+	}
+
+	if request.Len() == 0 {
+		return nil
+	}
+
+	return send()
+}
+
+// send posts a request of events and, with Acknowledgement, waits for them to
+// be indexed.
+func (s *SplunkForwarder) send(ctx context.Context, events []byte) error {
+	if !s.Acknowledgement {
+		return s.post(ctx, splunkEventPath, events, nil)
+	}
+
+	var response splunkResponse
+	if err := s.post(ctx, splunkEventPath, events, &response); err != nil {
+		return err
+	}
+
+	if response.AckID == nil {
+		return Permanent(errors.New("SplunkForwarder: response has no ack ID, is indexer acknowledgement enabled for the token?"))
+	}
+
+	return s.waitForAck(ctx, *response.AckID)
+}
+
+func (s *SplunkForwarder) event(line []byte) splunkEvent {
+	event := splunkEvent{
+		Host:       s.Host,
+		Source:     s.Source,
+		SourceType: s.SourceType,
+		Index:      s.Index,
+	}
+
+	line = bytes.TrimSpace(line)
+	if line[0] == '{' && json.Valid(line) {
+		event.Event = line
+
+		if value, ok := jsonField(line, []string{s.TimestampField}); ok {
+			if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				// Seconds with millisecond precision
+				event.Time = json.RawMessage(strconv.FormatFloat(float64(parsed.UnixNano()/int64(time.Millisecond))/1000, 'f', 3, 64))
+			}
+		}
+	} else {
+		event.Event, _ = json.Marshal(string(line))
+	}
+
+	return event
+}
+
+// waitForAck polls HEC until ackID is indexed, first right away and then
+// every AckPollInterval.
+func (s *SplunkForwarder) waitForAck(ctx context.Context, ackID int64) error {
+	deadline := time.Now().Add(s.AckTimeout)
+	body := []byte(fmt.Sprintf(`{"acks":[%d]}`, ackID))
+
+	for {
+		var response struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		if err := s.post(ctx, splunkAckPath, body, &response); err != nil {
+			return err
+		}
+
+		if response.Acks[strconv.FormatInt(ackID, 10)] {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return Permanent(fmt.Errorf("%w: ack %d not indexed within %s", ErrSplunkAckTimeout, ackID, s.AckTimeout))
+		}
+
+		if err := sleep(ctx, s.AckPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// post sends body to path, decoding the response into response unless it is
+// nil.
+func (s *SplunkForwarder) post(ctx context.Context, path string, body []byte, response interface{}) error {
+	payload := body
+	compressed := s.Compression != nil && path == splunkEventPath
+	if compressed {
+		var buffer bytes.Buffer
+		if err := compress.Encode(s.Compression, &buffer, body); err != nil {
+			return Permanent(err)
+		}
+		payload = buffer.Bytes()
+	}
+
+	req, err := retryablehttp.NewRequest("POST", s.Endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return Permanent(err)
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Add("Authorization", "Splunk "+s.Token)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Splunk-Request-Channel", s.Channel)
+	if compressed {
+		req.Header.Add("Content-Encoding", s.Compression.Encoding())
+	}
+
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return statusError("SplunkForwarder", resp)
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("SplunkForwarder: could not decode response: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/timberio/timber-go/metadata"
+)
+
+// Lines should be sent as HEC events, and Forward should wait for them to be
+// acknowledged
+func TestSplunkForwarderAcknowledgement(test *testing.T) {
+	events := make(chan []splunkEvent, 1)
+	var polls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Splunk secret" || r.Header.Get("X-Splunk-Request-Channel") == "" {
+			test.Errorf("unexpected headers %v", r.Header)
+		}
+
+		switch r.URL.Path {
+		case splunkEventPath:
+			var received []splunkEvent
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				var event splunkEvent
+				json.Unmarshal(scanner.Bytes(), &event)
+				received = append(received, event)
+			}
+			events <- received
+
+			fmt.Fprint(w, `{"text":"Success","code":0,"ackId":7}`)
+		case splunkAckPath:
+			// Indexed on the second poll
+			indexed := atomic.AddInt32(&polls, 1) > 1
+			fmt.Fprintf(w, `{"acks":{"7":%t}}`, indexed)
+		}
+	}))
+	defer server.Close()
+
+	logEvent := metadata.NewLogEvent()
+	logEvent.AddHostname("web-1")
+
+	forwarder, err := NewSplunkForwarder(server.URL, "secret", SplunkConfig{
+		SourceType:      "_json",
+		Index:           "main",
+		LogEvent:        logEvent,
+		Acknowledgement: true,
+		AckPollInterval: time.Millisecond,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	buffer := bytes.NewBufferString(`{"dt":"2019-01-01T00:00:01.5Z","message":"structured"}
+plain line
+`)
+
+	if err := forwarder.Forward(context.Background(), buffer); err != nil {
+		test.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&polls) != 2 {
+		test.Fatalf("expected Forward to poll until acknowledged, polled %d times", polls)
+	}
+
+	received := <-events
+	if len(received) != 2 {
+		test.Fatalf("expected 2 events, got %d", len(received))
+	}
+
+	structured := received[0]
+	if string(structured.Time) != "1546300801.500" || structured.Host != "web-1" ||
+		structured.SourceType != "_json" || structured.Index != "main" {
+		test.Fatalf("unexpected event %+v", structured)
+	}
+
+	if string(structured.Event) != `{"dt":"2019-01-01T00:00:01.5Z","message":"structured"}` {
+		test.Fatalf("expected JSON lines to be sent as structured events, got %s", structured.Event)
+	}
+
+	if string(received[1].Event) != `"plain line"` || received[1].Time != nil {
+		test.Fatalf("expected other lines to be sent as strings, got %+v", received[1])
+	}
+}
+
+// Events that are not acknowledged in time were accepted, so they should not
+// be retried
+func TestSplunkForwarderAckTimeout(test *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == splunkEventPath {
+			fmt.Fprint(w, `{"text":"Success","code":0,"ackId":1}`)
+			return
+		}
+		fmt.Fprint(w, `{"acks":{"1":false}}`)
+	}))
+	defer server.Close()
+
+	forwarder, err := NewSplunkForwarder(server.URL, "secret", SplunkConfig{
+		Acknowledgement: true,
+		AckPollInterval: time.Millisecond,
+		AckTimeout:      10 * time.Millisecond,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	err = forwarder.Forward(context.Background(), bytes.NewBufferString("line\n"))
+	if !errors.Is(err, ErrSplunkAckTimeout) || !IsPermanent(err) {
+		test.Fatalf("expected a permanent ErrSplunkAckTimeout, got %v", err)
+	}
+}
+
+// Buffers larger than MaxContentLength should be sent in several requests,
+// leaving only the lines of failed requests for a retry
+func TestSplunkForwarderMaxContentLength(test *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	forwarder, err := NewSplunkForwarder(server.URL, "secret", SplunkConfig{
+		// Room for two events per request
+		MaxContentLength: 40,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	forwarder.HTTPClient.RetryMax = 0
+
+	buffer := bytes.NewBufferString("first\nsecond\nthird\nfourth\nfifth\nsixth\n")
+	err = forwarder.Forward(context.Background(), buffer)
+
+	if atomic.LoadInt32(&requests) != 3 {
+		test.Fatalf("expected 3 requests, got %d", requests)
+	}
+
+	if err == nil || IsPermanent(err) || Remaining(buffer, err).String() != "fifth\nsixth\n" {
+		test.Fatalf("expected the lines of the failed request to remain, got %v", err)
+	}
+}
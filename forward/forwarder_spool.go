@@ -0,0 +1,305 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/timberio/timber-go/logging"
+)
+
+var (
+	defaultSpoolMaxSize       int64 = 100 * 1024 * 1024
+	defaultSpoolRetryInterval       = 5 * time.Second
+)
+
+// SpoolForwarder writes every buffer to an on-disk spool before handing it to
+// another Forwarder in the background. Segments are only deleted once the
+// wrapped Forwarder reports success (or a permanent failure), and any left on
+// disk are replayed when a SpoolForwarder is created for the same directory.
+type SpoolForwarder struct {
+	Dir       string
+	Forwarder Forwarder
+
+	SpoolConfig
+
+	mutex    sync.Mutex
+	segments []segment
+	size     int64
+	nextSeq  uint64
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type SpoolConfig struct {
+	// MaxSize bounds the bytes kept on disk. When a new buffer would exceed
+	// it, the oldest segments are evicted.
+	MaxSize int64
+	// RetryInterval is how long to wait after a retryable failure before
+	// trying the oldest segment again.
+	RetryInterval time.Duration
+
+	// Results, when set, receives the outcome of every delivery attempt and
+	// of every eviction. Sends block, so the channel must be drained.
+	Results chan<- Result
+
+	Logger logging.Logger
+}
+
+func DefaultSpoolConfig() SpoolConfig {
+	return SpoolConfig{
+		MaxSize:       defaultSpoolMaxSize,
+		RetryInterval: defaultSpoolRetryInterval,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+func NewSpoolForwarder(dir string, forwarder Forwarder, config SpoolConfig) (*SpoolForwarder, error) {
+	defaultConfig := DefaultSpoolConfig()
+
+	if config.MaxSize == 0 {
+		config.MaxSize = defaultConfig.MaxSize
+	}
+
+	if config.RetryInterval == 0 {
+		config.RetryInterval = defaultConfig.RetryInterval
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	spool := &SpoolForwarder{
+		Dir:         dir,
+		Forwarder:   forwarder,
+		SpoolConfig: config,
+
+		segments: segments,
+		nextSeq:  1,
+
+		wake:   make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	for _, seg := range segments {
+		spool.size += seg.size
+		spool.nextSeq = seg.seq + 1
+	}
+
+	if len(segments) > 0 {
+		config.Logger.Printf("SpoolForwarder: replaying %d spooled buffers from %s", len(segments), dir)
+	}
+
+	go spool.deliver()
+
+	return spool, nil
+}
+
+// Forward persists buffer to disk and returns once it is safely spooled;
+// delivery happens in the background.
+func (s *SpoolForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	if buffer.Len() == 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+
+	size := int64(buffer.Len() + segmentHeaderSize)
+	if size > s.MaxSize {
+		s.mutex.Unlock()
+		return Permanent(fmt.Errorf("SpoolForwarder: buffer of %d bytes exceeds the spool size of %d bytes", buffer.Len(), s.MaxSize))
+	}
+
+	var evicted []segment
+	for s.size+size > s.MaxSize && len(s.segments) > 0 {
+		evicted = append(evicted, s.segments[0])
+		s.size -= s.segments[0].size
+		s.segments = s.segments[1:]
+	}
+
+	seg, err := writeSegment(s.Dir, s.nextSeq, buffer.Bytes())
+	if err == nil {
+		s.nextSeq++
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+	}
+
+	s.mutex.Unlock()
+
+	for _, old := range evicted {
+		s.evict(old)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Pending is the number of spooled buffers that have not been delivered.
+func (s *SpoolForwarder) Pending() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.segments)
+}
+
+// Close stops delivering spooled buffers. Undelivered buffers remain on disk
+// and are replayed by the next SpoolForwarder using the same directory.
+func (s *SpoolForwarder) Close(ctx context.Context) error {
+	s.cancel()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SpoolForwarder) deliver() {
+	defer close(s.done)
+
+	for {
+		seg, ok := s.oldest()
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.ctx.Done():
+				return
+			}
+		}
+
+		buffer, err := readSegment(seg)
+		if os.IsNotExist(err) {
+			// Evicted while waiting to be delivered
+			s.remove(seg)
+			continue
+		}
+
+		if err != nil {
+			s.Logger.Printf("SpoolForwarder: discarding unreadable segment %s: %s", seg.path, err)
+			s.remove(seg)
+			s.report(NewResult(nil, Permanent(err)))
+			continue
+		}
+
+		result := NewResult(buffer, s.Forwarder.Forward(s.ctx, buffer))
+		if s.ctx.Err() != nil {
+			// Interrupted by Close, leave the segment for the next run
+			return
+		}
+
+		s.report(result)
+
+		if result.Status == StatusRetryable {
+			if remaining := Remaining(buffer, result.Err); remaining != buffer {
+				// Only retry the lines that were not delivered
+				s.replace(seg, remaining.Bytes())
+			}
+
+			select {
+			case <-time.After(s.RetryInterval):
+				continue
+			case <-s.ctx.Done():
+				return
+			}
+		}
+
+		if result.Status == StatusPermanent {
+			s.Logger.Printf("SpoolForwarder: discarding segment %s after permanent failure: %s", seg.path, result.Err)
+		}
+
+		s.remove(seg)
+	}
+}
+
+func (s *SpoolForwarder) oldest() (segment, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.segments) == 0 {
+		return segment{}, false
+	}
+
+	return s.segments[0], true
+}
+
+// remove deletes a segment unless it has already been evicted.
+func (s *SpoolForwarder) remove(seg segment) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, candidate := range s.segments {
+		if candidate.seq == seg.seq {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			s.size -= seg.size
+			if err := removeSegment(seg); err != nil {
+				s.Logger.Printf("SpoolForwarder: could not remove segment %s: %s", seg.path, err)
+			}
+			return
+		}
+	}
+}
+
+// replace rewrites a partly delivered segment with the lines that remain,
+// unless it has been evicted in the meantime.
+func (s *SpoolForwarder) replace(seg segment, payload []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, candidate := range s.segments {
+		if candidate.seq == seg.seq {
+			replaced, err := writeSegment(s.Dir, seg.seq, payload)
+			if err != nil {
+				s.Logger.Printf("SpoolForwarder: could not rewrite segment %s: %s", seg.path, err)
+				return
+			}
+
+			s.segments[i] = replaced
+			s.size += replaced.size - candidate.size
+			return
+		}
+	}
+}
+
+func (s *SpoolForwarder) evict(seg segment) {
+	removeSegment(seg)
+
+	err := fmt.Errorf("SpoolForwarder: evicted segment %s (%d bytes) to stay within %d bytes", seg.path, seg.size, s.MaxSize)
+	s.Logger.Print(err)
+	s.report(NewResult(nil, Permanent(err)))
+}
+
+func (s *SpoolForwarder) report(result Result) {
+	if s.Results != nil {
+		s.Results <- result
+	}
+}
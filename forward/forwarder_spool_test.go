@@ -0,0 +1,175 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func waitFor(test *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			test.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Buffers that could not be delivered should be replayed by the next spool
+// created for the same directory
+func TestSpoolForwarderReplay(test *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	failing := ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+		return errors.New("endpoint is down")
+	})
+
+	spool, err := NewSpoolForwarder(dir, failing, SpoolConfig{
+		RetryInterval: time.Hour,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	spool.Forward(context.Background(), bytes.NewBufferString("test log line\n"))
+	spool.Close(context.Background())
+
+	if spool.Pending() != 1 {
+		test.Fatalf("expected 1 pending buffer, got %d", spool.Pending())
+	}
+
+	delivered := make(chan string, 1)
+	working := ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+		delivered <- buffer.String()
+		return nil
+	})
+
+	spool, err = NewSpoolForwarder(dir, working, SpoolConfig{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer spool.Close(context.Background())
+
+	if actual := <-delivered; actual != "test log line\n" {
+		test.Fatalf("expected \"test log line\", got \"%s\"", actual)
+	}
+
+	waitFor(test, func() bool { return spool.Pending() == 0 })
+
+	segments, _ := listSegments(dir)
+	if len(segments) != 0 {
+		test.Fatalf("expected delivered segments to be deleted, found %d", len(segments))
+	}
+}
+
+// After a partial failure, only the remaining lines should be retried
+func TestSpoolForwarderPartial(test *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	delivered := make(chan string, 2)
+	attempts := 0
+	partial := ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+		delivered <- buffer.String()
+		attempts++
+		if attempts == 1 {
+			return Partial([]byte("second\n"), errors.New("endpoint is down"))
+		}
+		return nil
+	})
+
+	spool, err := NewSpoolForwarder(dir, partial, SpoolConfig{
+		RetryInterval: time.Millisecond,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer spool.Close(context.Background())
+
+	spool.Forward(context.Background(), bytes.NewBufferString("first\nsecond\n"))
+
+	if actual := <-delivered; actual != "first\nsecond\n" {
+		test.Fatalf("expected the whole buffer, got \"%s\"", actual)
+	}
+
+	if actual := <-delivered; actual != "second\n" {
+		test.Fatalf("expected only the remaining line to be retried, got \"%s\"", actual)
+	}
+
+	waitFor(test, func() bool { return spool.Pending() == 0 })
+}
+
+// The oldest segments should be evicted once the spool exceeds its max size
+func TestSpoolForwarderEviction(test *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	blocked := make(chan struct{})
+	forwarder := ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+		<-blocked
+		return errors.New("endpoint is down")
+	})
+
+	results := make(chan Result, 10)
+	spool, err := NewSpoolForwarder(dir, forwarder, SpoolConfig{
+		MaxSize: int64(2 * (segmentHeaderSize + 10)),
+		Results: results,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	for _, line := range []string{"line one\n\n", "line two\n\n", "line 333\n\n"} {
+		if err := spool.Forward(context.Background(), bytes.NewBufferString(line)); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	if spool.Pending() != 2 {
+		test.Fatalf("expected 2 pending buffers, got %d", spool.Pending())
+	}
+
+	if result := <-results; result.Status != StatusPermanent {
+		test.Fatalf("expected eviction to be reported as a permanent failure, got %s", result.Status)
+	}
+
+	close(blocked)
+	spool.Close(context.Background())
+}
+
+// Corrupted segments should fail their checksum
+func TestSpoolSegmentChecksum(test *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	seg, err := writeSegment(dir, 1, []byte("test log line\n"))
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(seg.path)
+	data[len(data)-2] = 'X'
+	ioutil.WriteFile(seg.path, data, 0644)
+
+	if _, err := readSegment(seg); err != errCorruptSegment {
+		test.Fatalf("expected corrupt segment error, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package forward
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"os"
 
 	"github.com/timberio/timber-go/logging"
@@ -22,18 +23,13 @@ func NewStdoutForwarder(logger logging.Logger) *StdoutForwarder {
 	}
 }
 
-func (s *StdoutForwarder) Forward(buffer *bytes.Buffer) {
+func (s *StdoutForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
 	writer := bufio.NewWriter(os.Stdout)
 
 	_, err := writer.Write(buffer.Bytes())
 	if err != nil {
-		s.Logger.Print(err)
-		return
+		return err
 	}
 
-	err = writer.Flush()
-	if err != nil {
-		s.Logger.Print(err)
-		return
-	}
+	return writer.Flush()
 }
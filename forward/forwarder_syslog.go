@@ -0,0 +1,317 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timberio/timber-go/logging"
+)
+
+var (
+	defaultSyslogNetwork     = "udp"
+	defaultSyslogDialTimeout = 10 * time.Second
+)
+
+type SyslogFormat int
+
+const (
+	// SyslogRFC5424 formats messages as described by RFC 5424.
+	SyslogRFC5424 SyslogFormat = iota
+	// SyslogRFC3164 formats messages in the older BSD syslog format.
+	SyslogRFC3164
+)
+
+// SyslogFraming separates messages sent over a stream (TCP) connection, as
+// described by RFC 6587. Messages sent over UDP are never framed.
+type SyslogFraming int
+
+const (
+	// SyslogOctetCounting prefixes each message with its length.
+	SyslogOctetCounting SyslogFraming = iota
+	// SyslogNonTransparent terminates each message with a newline.
+	SyslogNonTransparent
+)
+
+// Syslog severities, from RFC 5424.
+const (
+	SeverityEmergency = iota
+	SeverityAlert
+	SeverityCritical
+	SeverityError
+	SeverityWarning
+	SeverityNotice
+	SeverityInfo
+	SeverityDebug
+)
+
+// Syslog facilities commonly used by applications, from RFC 5424.
+const (
+	// FacilityKern selects the kernel facility, whose code is 0, since a zero
+	// Facility selects the default, FacilityUser.
+	FacilityKern   = -1
+	FacilityUser   = 1
+	FacilityLocal0 = 16
+	FacilityLocal1 = 17
+	FacilityLocal2 = 18
+	FacilityLocal3 = 19
+	FacilityLocal4 = 20
+	FacilityLocal5 = 21
+	FacilityLocal6 = 22
+	FacilityLocal7 = 23
+)
+
+// SyslogForwarder sends every line of a buffer as a syslog message.
+type SyslogForwarder struct {
+	Address string
+
+	SyslogConfig
+
+	conn *reconnectingConn
+}
+
+type SyslogConfig struct {
+	// Network is "udp" or "tcp". When TLSConfig is set, TCP connections use
+	// TLS.
+	Network   string
+	TLSConfig *tls.Config
+
+	Format  SyslogFormat
+	Framing SyslogFraming
+
+	Facility int
+	// Severity maps each line to a syslog severity. By default, the "level"
+	// field of JSON lines is used, falling back to SeverityInfo.
+	Severity func(line []byte) int
+
+	Hostname string
+	AppName  string
+	// StructuredData is included verbatim in RFC 5424 messages, e.g.
+	// `[origin software="timber-go"]`.
+	StructuredData string
+
+	DialTimeout time.Duration
+	// WriteTimeout bounds each write, so that a stalled server cannot block
+	// Forward indefinitely.
+	WriteTimeout time.Duration
+
+	Logger logging.Logger
+}
+
+func DefaultSyslogConfig() SyslogConfig {
+	hostname, _ := os.Hostname()
+
+	return SyslogConfig{
+		Network:  defaultSyslogNetwork,
+		Facility: FacilityUser,
+		Severity: SeverityFromLevel,
+
+		Hostname: hostname,
+		AppName:  filepath.Base(os.Args[0]),
+
+		DialTimeout:  defaultSyslogDialTimeout,
+		WriteTimeout: defaultSocketWriteTimeout,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+func NewSyslogForwarder(address string, config SyslogConfig) (*SyslogForwarder, error) {
+	defaultConfig := DefaultSyslogConfig()
+
+	if config.Network == "" {
+		config.Network = defaultConfig.Network
+	}
+
+	if config.Network != "udp" && config.Network != "tcp" {
+		return nil, fmt.Errorf("SyslogForwarder: unsupported network %q", config.Network)
+	}
+
+	if config.Facility == 0 {
+		config.Facility = defaultConfig.Facility
+	}
+
+	if config.Severity == nil {
+		config.Severity = defaultConfig.Severity
+	}
+
+	if config.Hostname == "" {
+		config.Hostname = defaultConfig.Hostname
+	}
+
+	if config.AppName == "" {
+		config.AppName = defaultConfig.AppName
+	}
+
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultConfig.DialTimeout
+	}
+
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = defaultConfig.WriteTimeout
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	s := &SyslogForwarder{
+		Address:      address,
+		SyslogConfig: config,
+	}
+
+	s.conn = newReconnectingConn(s.dial, config.WriteTimeout, defaultMinBackoff, defaultMaxBackoff)
+
+	return s, nil
+}
+
+func (s *SyslogForwarder) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.DialTimeout}
+
+	if s.Network == "tcp" && s.TLSConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: s.TLSConfig}
+		return tlsDialer.DialContext(ctx, "tcp", s.Address)
+	}
+
+	return dialer.DialContext(ctx, s.Network, s.Address)
+}
+
+// Forward sends each line of buffer as a syslog message. Over TCP the framed
+// messages are written together; over UDP each is sent as its own datagram.
+// A failure part way returns a PartialError holding the lines that were not
+// sent in full.
+func (s *SyslogForwarder) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	now := time.Now()
+	var payload bytes.Buffer
+
+	body := buffer.Bytes()
+	sent := false
+	var frames []frameOffset
+	for offset := 0; offset < len(body); {
+		line := body[offset:]
+		if end := bytes.IndexByte(line, '\n'); end >= 0 {
+			line = line[:end]
+		}
+		start := offset
+		offset += len(line) + 1
+
+		if len(line) == 0 {
+			continue
+		}
+
+		message := s.format(line, now)
+
+		if s.Network == "udp" {
+			if _, err := s.conn.write(ctx, message); err != nil {
+				if sent {
+					return Partial(body[start:], err)
+				}
+				return err
+			}
+			sent = true
+			continue
+		}
+
+		frames = append(frames, frameOffset{payload: payload.Len(), line: start})
+		if s.Framing == SyslogOctetCounting {
+			payload.WriteString(strconv.Itoa(len(message)))
+			payload.WriteByte(' ')
+			payload.Write(message)
+		} else {
+			payload.Write(message)
+			payload.WriteByte('\n')
+		}
+	}
+
+	if payload.Len() == 0 {
+		return nil
+	}
+
+	_, err := s.conn.write(ctx, payload.Bytes())
+	return unwrittenLines(err, body, frames)
+}
+
+// format builds a single syslog message for line.
+func (s *SyslogForwarder) format(line []byte, now time.Time) []byte {
+	facility := s.Facility
+	if facility == FacilityKern {
+		facility = 0
+	}
+
+	priority := facility*8 + s.Severity(line)
+	var message bytes.Buffer
+
+	if s.Format == SyslogRFC3164 {
+		fmt.Fprintf(&message, "<%d>%s %s %s[%d]: ",
+			priority, now.Format(time.Stamp), s.Hostname, s.AppName, os.Getpid())
+	} else {
+		structuredData := s.StructuredData
+		if structuredData == "" {
+			structuredData = "-"
+		}
+
+		fmt.Fprintf(&message, "<%d>1 %s %s %s %d - %s ",
+			priority, now.Format("2006-01-02T15:04:05.000000Z07:00"), syslogField(s.Hostname),
+			syslogField(s.AppName), os.Getpid(), structuredData)
+	}
+
+	message.Write(line)
+	return message.Bytes()
+}
+
+// Close closes the connection. Forward returns an error once closed.
+func (s *SyslogForwarder) Close(ctx context.Context) error {
+	return s.conn.close()
+}
+
+// syslogField replaces an empty header field with the nil value "-".
+func syslogField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Replace(value, " ", "_", -1)
+}
+
+// SeverityFromLevel maps the "level" (or "severity") field of a JSON line to
+// a syslog severity, defaulting to SeverityInfo.
+func SeverityFromLevel(line []byte) int {
+	level, ok := jsonField(line, []string{"level"})
+	if !ok {
+		level, ok = jsonField(line, []string{"severity"})
+	}
+	if !ok {
+		return SeverityInfo
+	}
+
+	return syslogSeverity(level)
+}
+
+// syslogSeverity maps a level name to a syslog severity, defaulting to
+// SeverityInfo.
+func syslogSeverity(level string) int {
+	switch strings.ToLower(level) {
+	case "emergency", "emerg", "panic":
+		return SeverityEmergency
+	case "alert":
+		return SeverityAlert
+	case "critical", "crit", "fatal":
+		return SeverityCritical
+	case "error", "err":
+		return SeverityError
+	case "warning", "warn":
+		return SeverityWarning
+	case "notice":
+		return SeverityNotice
+	case "debug", "trace":
+		return SeverityDebug
+	default:
+		return SeverityInfo
+	}
+}
@@ -0,0 +1,197 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Lines should be sent as RFC 5424 messages, one per UDP datagram
+func TestSyslogForwarderUDP(test *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	forwarder, err := NewSyslogForwarder(listener.LocalAddr().String(), SyslogConfig{
+		Facility:       FacilityLocal0,
+		Hostname:       "web-1",
+		AppName:        "app",
+		StructuredData: `[origin software="timber-go"]`,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	err = forwarder.Forward(context.Background(), bytes.NewBufferString("{\"level\":\"error\",\"message\":\"failed\"}\nplain line\n"))
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	expected := []*regexp.Regexp{
+		regexp.MustCompile(`^<131>1 \S+ web-1 app \d+ - \[origin software="timber-go"\] \{"level":"error","message":"failed"\}$`),
+		regexp.MustCompile(`^<134>1 \S+ web-1 app \d+ - \[origin software="timber-go"\] plain line$`),
+	}
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, pattern := range expected {
+		datagram := make([]byte, 1024)
+		n, _, err := listener.ReadFrom(datagram)
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		if !pattern.Match(datagram[:n]) {
+			test.Fatalf("expected message matching %s, got \"%s\"", pattern, datagram[:n])
+		}
+	}
+}
+
+// A UDP failure part way through a buffer should leave only the unsent lines
+// for a retry
+func TestSyslogForwarderUDPPartial(test *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	forwarder, err := NewSyslogForwarder(listener.LocalAddr().String(), SyslogConfig{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	// Too large for a single datagram
+	large := strings.Repeat("x", 70000) + "\n"
+	buffer := bytes.NewBufferString("first\n" + large + "last\n")
+
+	err = forwarder.Forward(context.Background(), buffer)
+	if err == nil || Remaining(buffer, err).String() != large+"last\n" {
+		test.Fatalf("expected the lines from the failed one on to remain, got %v", err)
+	}
+}
+
+// A TCP write failing part way should leave the lines whose messages were not
+// completely written for a retry
+func TestSyslogForwarderTCPPartial(test *testing.T) {
+	forwarder, err := NewSyslogForwarder("127.0.0.1:514", SyslogConfig{Network: "tcp"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	forwarder.conn = newReconnectingConn(func(ctx context.Context) (net.Conn, error) {
+		return halfConn{}, nil
+	}, 0, time.Millisecond, time.Millisecond)
+
+	// Half of the payload ends in the middle of the second message
+	buffer := bytes.NewBufferString("a\nb\nc\n")
+	err = forwarder.Forward(context.Background(), buffer)
+
+	if err == nil || Remaining(buffer, err).String() != "b\nc\n" {
+		test.Fatalf("expected the second and third lines to remain, got %v", err)
+	}
+}
+
+// FacilityKern should select facility 0 rather than the default
+func TestSyslogForwarderKernFacility(test *testing.T) {
+	forwarder, err := NewSyslogForwarder("127.0.0.1:514", SyslogConfig{
+		Facility: FacilityKern,
+		Severity: func(line []byte) int { return SeverityError },
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	if message := forwarder.format([]byte("panic"), time.Now()); !bytes.HasPrefix(message, []byte("<3>1 ")) {
+		test.Fatalf("expected priority 3, got \"%s\"", message)
+	}
+}
+
+// Messages sent over TCP should use octet-counting framing, and the
+// forwarder should reconnect after the connection is lost
+func TestSyslogForwarderTCPReconnect(test *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer listener.Close()
+
+	messages := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			reader := bufio.NewReader(conn)
+			length, _ := reader.ReadString(' ')
+			size, _ := strconv.Atoi(strings.TrimSpace(length))
+			message := make([]byte, size)
+			reader.Read(message)
+			messages <- string(message)
+
+			// Drop the connection after every message
+			conn.Close()
+		}
+	}()
+
+	forwarder, err := NewSyslogForwarder(listener.Addr().String(), SyslogConfig{
+		Network: "tcp",
+		Format:  SyslogRFC3164,
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer forwarder.Close(context.Background())
+
+	for _, line := range []string{"first", "second"} {
+		// Writes to a connection closed by the peer can appear to succeed, so
+		// keep forwarding until the message arrives on a new connection
+		deadline := time.After(5 * time.Second)
+		var message string
+
+	receive:
+		for {
+			forwarder.Forward(context.Background(), bytes.NewBufferString(line+"\n"))
+
+			select {
+			case message = <-messages:
+				// Skip duplicates of the previous line
+				if strings.HasSuffix(message, ": "+line) {
+					break receive
+				}
+			case <-time.After(50 * time.Millisecond):
+			case <-deadline:
+				test.Fatalf("expected to receive \"%s\"", line)
+			}
+		}
+
+		if !strings.HasPrefix(message, "<14>") {
+			test.Fatalf("unexpected RFC 3164 message \"%s\"", message)
+		}
+	}
+}
+
+func TestSeverityFromLevel(test *testing.T) {
+	cases := map[string]int{
+		`{"level":"warn"}`:     SeverityWarning,
+		`{"severity":"DEBUG"}`: SeverityDebug,
+		`not json`:             SeverityInfo,
+	}
+
+	for line, expected := range cases {
+		if actual := SeverityFromLevel([]byte(line)); actual != expected {
+			test.Fatalf("expected severity %d for %s, got %d", expected, line, actual)
+		}
+	}
+}
@@ -2,14 +2,204 @@ package forward
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/timberio/timber-go/logging"
 )
 
+// Forwarder accepts a buffer and writes it somewhere, reporting whether the
+// write succeeded. Errors wrapped with Permanent signal that retrying the same
+// buffer will not help. Forwarders must not retain the buffer after Forward
+// returns, since it may be reused for a later batch.
 type Forwarder interface {
+	Forward(ctx context.Context, buffer *bytes.Buffer) error
+}
+
+// Closer is implemented by forwarders that hold resources, such as files or
+// background workers, which should be released once forwarding is done.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// closeDestinations closes every destination that implements Closer,
+// combining their errors.
+func closeDestinations(ctx context.Context, owner string, destinations []Destination) error {
+	var errs []string
+	for _, destination := range destinations {
+		if closer, ok := destination.Forwarder.(Closer); ok {
+			if err := closer.Close(ctx); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", destination.Name, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: could not close %s", owner, strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// LegacyForwarder is the interface forwarders implemented before they could
+// report errors. Use FromLegacy to adapt one to Forwarder.
+type LegacyForwarder interface {
 	Forward(*bytes.Buffer)
 }
 
-func Forward(bufferChan chan *bytes.Buffer, forwarder Forwarder) {
-	for buffer := range bufferChan {
+// ForwarderFunc allows an ordinary function to be used as a Forwarder.
+type ForwarderFunc func(ctx context.Context, buffer *bytes.Buffer) error
+
+func (f ForwarderFunc) Forward(ctx context.Context, buffer *bytes.Buffer) error {
+	return f(ctx, buffer)
+}
+
+// FromLegacy adapts a LegacyForwarder to Forwarder. Legacy forwarders cannot
+// report failures, so every buffer is reported as delivered.
+func FromLegacy(forwarder LegacyForwarder) Forwarder {
+	return ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
 		forwarder.Forward(buffer)
+		return nil
+	})
+}
+
+type ForwardConfig struct {
+	// Workers is the number of buffers forwarded concurrently.
+	Workers int
+	// MaxInFlight bounds the number of buffers taken from bufferChan that are
+	// queued or being forwarded. It defaults to Workers.
+	MaxInFlight int
+	// Partition, when set, assigns every buffer to a stream. Buffers in the
+	// same stream are forwarded one at a time, in the order they were received.
+	Partition func(*bytes.Buffer) string
+
+	// Metrics, when set, is updated as buffers move through the workers.
+	Metrics *Metrics
+
+	// Results receives the outcome of every buffer. Sends block, so the
+	// channel must be drained for forwarding to make progress.
+	Results chan<- Result
+
+	// Release, when set, is called with every buffer once it has been
+	// forwarded, typically to return it to batch.Batcher.Release for reuse,
+	// which also lets batch.Config.WaitForRelease know it has been forwarded.
+	// Released buffers are not included in Results.
+	Release func(*bytes.Buffer)
+
+	// Logger reports failures when Results is nil.
+	Logger logging.Logger
+}
+
+func DefaultForwardConfig() ForwardConfig {
+	return ForwardConfig{
+		Workers: 1,
+
+		Logger: logging.DefaultLogger,
+	}
+}
+
+// Forward sends every buffer received on bufferChan to forwarder, logging
+// failures, until bufferChan is closed.
+func Forward(bufferChan chan *bytes.Buffer, forwarder Forwarder) {
+	ForwardWithConfig(context.Background(), bufferChan, forwarder, DefaultForwardConfig())
+}
+
+// ForwardWithConfig sends every buffer received on bufferChan to forwarder
+// using config.Workers concurrent workers, reporting each outcome on
+// config.Results. It returns once bufferChan is closed and every buffer has
+// been forwarded. ctx is passed to each Forward call; cancelling it does not
+// stop the loop, so that bufferChan is always drained.
+func ForwardWithConfig(ctx context.Context, bufferChan chan *bytes.Buffer, forwarder Forwarder, config ForwardConfig) {
+	defaultConfig := DefaultForwardConfig()
+
+	if config.Workers <= 0 {
+		config.Workers = defaultConfig.Workers
+	}
+
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = config.Workers
+	}
+
+	if config.Metrics == nil {
+		config.Metrics = &Metrics{}
+	}
+
+	if config.Logger == nil {
+		config.Logger = defaultConfig.Logger
+	}
+
+	// Without partitioning every worker shares a single queue
+	queues := make([]chan *bytes.Buffer, 1)
+	if config.Partition != nil {
+		queues = make([]chan *bytes.Buffer, config.Workers)
+	}
+	for i := range queues {
+		queues[i] = make(chan *bytes.Buffer, config.MaxInFlight)
+	}
+
+	slots := make(chan struct{}, config.MaxInFlight)
+	var wg sync.WaitGroup
+
+	for i := 0; i < config.Workers; i++ {
+		wg.Add(1)
+		go func(queue chan *bytes.Buffer) {
+			defer wg.Done()
+
+			for buffer := range queue {
+				config.Metrics.start()
+				result := NewResult(buffer, forwarder.Forward(ctx, buffer))
+				config.Metrics.finish(result)
+
+				if config.Release != nil {
+					config.Release(buffer)
+					result.Buffer = nil
+				}
+
+				config.report(result)
+				<-slots
+			}
+		}(queues[i%len(queues)])
+	}
+
+	for {
+		// Only take a buffer from the batcher once there is room for it
+		slots <- struct{}{}
+
+		buffer, ok := <-bufferChan
+		if !ok {
+			break
+		}
+
+		config.Metrics.enqueue()
+		queues[config.queueIndex(buffer, len(queues))] <- buffer
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+}
+
+func (config ForwardConfig) queueIndex(buffer *bytes.Buffer, queues int) int {
+	if queues == 1 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(config.Partition(buffer)))
+	return int(hash.Sum32() % uint32(queues))
+}
+
+func (config ForwardConfig) report(result Result) {
+	if config.Results != nil {
+		config.Results <- result
+		return
+	}
+
+	if result.Err != nil {
+		config.Logger.Printf("Forward: %s failure: %s", result.Status, result.Err)
 	}
 }
@@ -2,11 +2,20 @@ package forward
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/timberio/timber-go/compress"
+	"github.com/timberio/timber-go/logging"
 )
 
 func TestForwardForwarding(test *testing.T) {
@@ -85,3 +94,367 @@ func TestForwardMetadata(test *testing.T) {
 	})
 	Forward(bufChan, httpForwarder)
 }
+
+func TestForwardResults(test *testing.T) {
+	bufChan := make(chan *bytes.Buffer, 2)
+	bufChan <- bytes.NewBufferString("accepted\n")
+	bufChan <- bytes.NewBufferString("rejected\n")
+	close(bufChan)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) == "rejected\n" {
+			w.WriteHeader(401)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	httpForwarder, _ := NewHTTPForwarder("api key", Config{
+		Endpoint: ts.URL,
+	})
+
+	results := make(chan Result, 2)
+	ForwardWithConfig(context.Background(), bufChan, httpForwarder, ForwardConfig{
+		Results: results,
+	})
+
+	if result := <-results; result.Status != StatusSuccess || result.Err != nil {
+		test.Fatalf("expected success, got %s (%v)", result.Status, result.Err)
+	}
+
+	if result := <-results; result.Status != StatusPermanent || result.Buffer.String() != "rejected\n" {
+		test.Fatalf("expected permanent failure for rejected buffer, got %s (%v)", result.Status, result.Err)
+	}
+}
+
+type legacyForwarder struct {
+	forwarded []string
+}
+
+func (l *legacyForwarder) Forward(buffer *bytes.Buffer) {
+	l.forwarded = append(l.forwarded, buffer.String())
+}
+
+func TestFromLegacy(test *testing.T) {
+	bufChan := make(chan *bytes.Buffer, 1)
+	bufChan <- bytes.NewBufferString("test log line\n")
+	close(bufChan)
+
+	legacy := &legacyForwarder{}
+	Forward(bufChan, FromLegacy(legacy))
+
+	if len(legacy.forwarded) != 1 || legacy.forwarded[0] != "test log line\n" {
+		test.Fatalf("expected legacy forwarder to receive the buffer, got %+v", legacy.forwarded)
+	}
+}
+
+func TestForwardWorkers(test *testing.T) {
+	workers := 4
+	bufChan := make(chan *bytes.Buffer, workers)
+	for i := 0; i < workers; i++ {
+		bufChan <- bytes.NewBufferString("test log line\n")
+	}
+	close(bufChan)
+
+	// Every Forward call blocks until all workers are busy at once
+	var started sync.WaitGroup
+	started.Add(workers)
+	forwarder := ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+		started.Done()
+		started.Wait()
+		return nil
+	})
+
+	metrics := &Metrics{}
+	done := make(chan struct{})
+	go func() {
+		ForwardWithConfig(context.Background(), bufChan, forwarder, ForwardConfig{
+			Workers: workers,
+			Metrics: metrics,
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		test.Fatal("expected buffers to be forwarded concurrently")
+	}
+
+	if metrics.Succeeded() != int64(workers) || metrics.InFlight() != 0 || metrics.QueueDepth() != 0 {
+		test.Fatalf("unexpected metrics: %d succeeded, %d in flight, %d queued",
+			metrics.Succeeded(), metrics.InFlight(), metrics.QueueDepth())
+	}
+}
+
+func TestForwardPartitionOrdering(test *testing.T) {
+	bufChan := make(chan *bytes.Buffer)
+
+	var mutex sync.Mutex
+	forwarded := map[string][]string{}
+	forwarder := ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+		line := buffer.String()
+		mutex.Lock()
+		forwarded[line[:1]] = append(forwarded[line[:1]], line)
+		mutex.Unlock()
+		return nil
+	})
+
+	go func() {
+		for i := 0; i < 50; i++ {
+			bufChan <- bytes.NewBufferString(fmt.Sprintf("a%02d", i))
+			bufChan <- bytes.NewBufferString(fmt.Sprintf("b%02d", i))
+		}
+		close(bufChan)
+	}()
+
+	ForwardWithConfig(context.Background(), bufChan, forwarder, ForwardConfig{
+		Workers:     4,
+		MaxInFlight: 8,
+		Partition: func(buffer *bytes.Buffer) string {
+			return buffer.String()[:1]
+		},
+	})
+
+	for stream, lines := range forwarded {
+		if !sort.StringsAreSorted(lines) || len(lines) != 50 {
+			test.Fatalf("expected stream %s to be forwarded in order, got %+v", stream, lines)
+		}
+	}
+}
+
+func TestForwardCompression(test *testing.T) {
+	bufChan := make(chan *bytes.Buffer, 1)
+	bufChan <- bytes.NewBufferString("test log line\n")
+	close(bufChan)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "gzip" {
+			test.Fatalf("expected gzip Content-Encoding, got \"%s\"", encoding)
+		}
+
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			test.Fatal(err)
+		}
+		output, _ := ioutil.ReadAll(reader)
+
+		if string(output) != "test log line\n" {
+			test.Fatalf("expected \"test log line\", got \"%s\"", output)
+		}
+
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	httpForwarder, _ := NewHTTPForwarder("api key", Config{
+		Endpoint:    ts.URL,
+		Compression: compress.Gzip,
+	})
+	Forward(bufChan, httpForwarder)
+}
+
+func TestForwardRelease(test *testing.T) {
+	bufChan := make(chan *bytes.Buffer, 1)
+	buffer := bytes.NewBufferString("test log line\n")
+	bufChan <- buffer
+	close(bufChan)
+
+	var released []*bytes.Buffer
+	results := make(chan Result, 1)
+	ForwardWithConfig(context.Background(), bufChan, ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+		return nil
+	}), ForwardConfig{
+		Results: results,
+		Release: func(buffer *bytes.Buffer) { released = append(released, buffer) },
+	})
+
+	if len(released) != 1 || released[0] != buffer {
+		test.Fatalf("expected the buffer to be released, got %+v", released)
+	}
+
+	if result := <-results; result.Buffer != nil {
+		test.Fatal("expected released buffers to be left out of results")
+	}
+}
+
+func BenchmarkForward(b *testing.B) {
+	pool := sync.Pool{New: func() interface{} { return bytes.NewBufferString("test log line\n") }}
+	forwarder := ForwarderFunc(func(ctx context.Context, buffer *bytes.Buffer) error {
+		return nil
+	})
+
+	bufChan := make(chan *bytes.Buffer)
+	done := make(chan struct{})
+	go func() {
+		ForwardWithConfig(context.Background(), bufChan, forwarder, ForwardConfig{
+			Release: func(buffer *bytes.Buffer) { pool.Put(buffer) },
+		})
+		close(done)
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bufChan <- pool.Get().(*bytes.Buffer)
+	}
+	close(bufChan)
+	<-done
+}
+
+func TestForwardSplitsTooLarge(test *testing.T) {
+	var mutex sync.Mutex
+	var accepted []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Count(string(body), "\n") > 1 {
+			w.WriteHeader(413)
+			return
+		}
+
+		mutex.Lock()
+		accepted = append(accepted, string(body))
+		mutex.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	httpForwarder, _ := NewHTTPForwarder("api key", Config{
+		Endpoint: ts.URL,
+		Logger:   logging.DiscardingLogger,
+	})
+
+	err := httpForwarder.Forward(context.Background(), bytes.NewBufferString("one\ntwo\nthree\n"))
+	if err != nil {
+		test.Fatalf("expected split batch to be accepted, got %s", err)
+	}
+
+	expected := []string{"one\n", "two\n", "three\n"}
+	if strings.Join(accepted, "") != strings.Join(expected, "") {
+		test.Fatalf("expected %+v, got %+v", expected, accepted)
+	}
+}
+
+// When a split half fails, the later halves should not be sent and only the
+// undelivered lines should be left for a retry
+func TestForwardSplitPartialFailure(test *testing.T) {
+	var mutex sync.Mutex
+	var accepted []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case strings.Count(string(body), "\n") > 1:
+			w.WriteHeader(413)
+		case string(body) == "two\n":
+			w.WriteHeader(400)
+		case string(body) == "three\n":
+			w.WriteHeader(408)
+		default:
+			mutex.Lock()
+			accepted = append(accepted, string(body))
+			mutex.Unlock()
+		}
+	}))
+	defer ts.Close()
+
+	httpForwarder, _ := NewHTTPForwarder("api key", Config{
+		Endpoint: ts.URL,
+		Logger:   logging.DiscardingLogger,
+	})
+	httpForwarder.HTTPClient.RetryMax = 0
+
+	buffer := bytes.NewBufferString("one\ntwo\nthree\nfour\n")
+	err := httpForwarder.Forward(context.Background(), buffer)
+
+	if err == nil || IsPermanent(err) || Remaining(buffer, err).String() != "three\nfour\n" {
+		test.Fatalf("expected a retryable error for the last two lines, got %v", err)
+	}
+
+	if strings.Join(accepted, "") != "one\n" {
+		test.Fatalf("expected only the first line to be accepted, got %+v", accepted)
+	}
+}
+
+func TestForwardAuthErrorIsPermanent(test *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(401)
+		w.Write([]byte("invalid API key"))
+	}))
+	defer ts.Close()
+
+	httpForwarder, _ := NewHTTPForwarder("api key", Config{
+		Endpoint: ts.URL,
+	})
+
+	err := httpForwarder.Forward(context.Background(), bytes.NewBufferString("test log line\n"))
+	if !IsPermanent(err) || !strings.Contains(err.Error(), "invalid API key") {
+		test.Fatalf("expected a permanent error including the response body, got %v", err)
+	}
+
+	if requests != 1 {
+		test.Fatalf("expected no retries, got %d requests", requests)
+	}
+}
+
+func TestForwardRetryAfter(test *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(429)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	httpForwarder, _ := NewHTTPForwarder("api key", Config{
+		Endpoint: ts.URL,
+	})
+	httpForwarder.HTTPClient.RetryWaitMin = 0
+
+	start := time.Now()
+	if err := httpForwarder.Forward(context.Background(), bytes.NewBufferString("test log line\n")); err != nil {
+		test.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		test.Fatalf("expected to wait for Retry-After, only waited %s", elapsed)
+	}
+}
+
+func TestParseRetryAfter(test *testing.T) {
+	now := time.Date(2018, 6, 6, 12, 0, 0, 0, time.UTC)
+
+	if wait, ok := parseRetryAfter("5", now); !ok || wait != 5*time.Second {
+		test.Fatalf("expected 5s, got %s", wait)
+	}
+
+	if wait, ok := parseRetryAfter("Wed, 06 Jun 2018 12:00:30 GMT", now); !ok || wait != 30*time.Second {
+		test.Fatalf("expected 30s, got %s", wait)
+	}
+
+	if _, ok := parseRetryAfter("soon", now); ok {
+		test.Fatal("expected an invalid Retry-After to be ignored")
+	}
+}
+
+// Retry-After should not make the client wait longer than RetryWaitMax
+func TestRetryAfterBackoffMax(test *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": []string{"60"}},
+	}
+
+	if wait := retryAfterBackoff(time.Second, 5*time.Second, 1, resp); wait != 5*time.Second {
+		test.Fatalf("expected the wait to be clamped to 5s, got %s", wait)
+	}
+}
@@ -0,0 +1,108 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/timberio/timber-go/logging"
+)
+
+var (
+	// Longest Retry-After delay that will be honored
+	maxRetryAfter = 2 * time.Minute
+
+	// Bytes of a rejected response body included in errors
+	responseSnippetSize int64 = 512
+)
+
+// newRetryableClient returns a client that retries connection errors, server
+// errors and throttling, honors Retry-After and returns the final response
+// once retries are exhausted so that its status can be inspected.
+func newRetryableClient(timeout time.Duration) *retryablehttp.Client {
+	httpClient := retryablehttp.NewClient()
+	httpClient.Logger = logging.DiscardingLogger
+	httpClient.HTTPClient.Timeout = timeout
+	httpClient.CheckRetry = retryPolicy
+	httpClient.Backoff = retryAfterBackoff
+	httpClient.ErrorHandler = retryablehttp.PassthroughErrorHandler
+
+	return httpClient
+}
+
+// retryPolicy extends the default policy to retry 429 Too Many Requests.
+func retryPolicy(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if err == nil && ctx.Err() == nil && resp.StatusCode == http.StatusTooManyRequests {
+		return true, nil
+	}
+
+	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+}
+
+// retryAfterBackoff waits for as long as the Retry-After header of a 429 or
+// 503 response asks, up to max, falling back to exponential backoff. The wait
+// does not end early when the request context is cancelled, so it must stay
+// bounded by RetryWaitMax.
+func retryAfterBackoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			if wait > max {
+				wait = max
+			}
+			return wait
+		}
+	}
+
+	return retryablehttp.DefaultBackoff(min, max, attemptNum, resp)
+}
+
+// parseRetryAfter accepts both forms of Retry-After: delay seconds and an
+// HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = date.Sub(now)
+	} else {
+		return 0, false
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+
+	return wait, true
+}
+
+// statusError describes an unsuccessful response, including the start of its
+// body. Client errors other than timeouts and throttling are permanent.
+func statusError(name string, resp *http.Response) error {
+	err := fmt.Errorf("%s: unexpected response (status code %d): %s", name, resp.StatusCode, responseSnippet(resp.Body))
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+		return Permanent(err)
+	}
+
+	return err
+}
+
+func responseSnippet(body io.Reader) string {
+	snippet, _ := ioutil.ReadAll(io.LimitReader(body, responseSnippetSize))
+	return strings.TrimSpace(string(snippet))
+}
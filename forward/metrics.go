@@ -0,0 +1,62 @@
+package forward
+
+import (
+	"sync/atomic"
+)
+
+// Metrics counts buffers as they move through ForwardWithConfig. It is safe to
+// read while forwarding is in progress.
+type Metrics struct {
+	queued    int64
+	inFlight  int64
+	succeeded int64
+	retryable int64
+	permanent int64
+}
+
+// QueueDepth is the number of buffers waiting for a free worker.
+func (m *Metrics) QueueDepth() int64 {
+	return atomic.LoadInt64(&m.queued)
+}
+
+// InFlight is the number of buffers currently being forwarded.
+func (m *Metrics) InFlight() int64 {
+	return atomic.LoadInt64(&m.inFlight)
+}
+
+// Succeeded is the number of buffers delivered.
+func (m *Metrics) Succeeded() int64 {
+	return atomic.LoadInt64(&m.succeeded)
+}
+
+// Retryable is the number of buffers that failed with a retryable error.
+func (m *Metrics) Retryable() int64 {
+	return atomic.LoadInt64(&m.retryable)
+}
+
+// Permanent is the number of buffers that failed with a permanent error.
+func (m *Metrics) Permanent() int64 {
+	return atomic.LoadInt64(&m.permanent)
+}
+
+func (m *Metrics) enqueue() {
+	atomic.AddInt64(&m.queued, 1)
+}
+
+func (m *Metrics) start() {
+	atomic.AddInt64(&m.queued, -1)
+	atomic.AddInt64(&m.inFlight, 1)
+}
+
+func (m *Metrics) finish(result Result) {
+	atomic.AddInt64(&m.inFlight, -1)
+
+	switch result.Status {
+	case StatusSuccess:
+		atomic.AddInt64(&m.succeeded, 1)
+	case StatusRetryable:
+		atomic.AddInt64(&m.retryable, 1)
+	case StatusPermanent:
+		atomic.AddInt64(&m.permanent, 1)
+	}
+}
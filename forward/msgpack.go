@@ -0,0 +1,352 @@
+package forward
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+var (
+	// Longest string, binary, array or map accepted by msgpackDecoder
+	maxMsgpackLength = 1024 * 1024
+
+	errMsgpackUnsupported = errors.New("msgpack: unsupported type")
+	errMsgpackTooLong     = errors.New("msgpack: value too long")
+)
+
+// The functions below encode and decode just enough of MessagePack for the
+// Fluent Forward protocol.
+
+// appendUint16, appendUint32 and appendUint64 append big endian integers, like
+// the binary.BigEndian append methods, which need Go 1.19.
+func appendUint16(b []byte, value uint16) []byte {
+	return append(b, byte(value>>8), byte(value))
+}
+
+func appendUint32(b []byte, value uint32) []byte {
+	return append(b, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func appendUint64(b []byte, value uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(value>>32)), uint32(value))
+}
+
+func appendMsgpackNil(b []byte) []byte {
+	return append(b, 0xc0)
+}
+
+func appendMsgpackBool(b []byte, value bool) []byte {
+	if value {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+func appendMsgpackInt(b []byte, value int64) []byte {
+	switch {
+	case value >= 0 && value <= 0x7f:
+		return append(b, byte(value))
+	case value >= -32 && value < 0:
+		return append(b, byte(value))
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		b = append(b, 0xd2)
+		return appendUint32(b, uint32(value))
+	default:
+		b = append(b, 0xd3)
+		return appendUint64(b, uint64(value))
+	}
+}
+
+func appendMsgpackFloat(b []byte, value float64) []byte {
+	b = append(b, 0xcb)
+	return appendUint64(b, math.Float64bits(value))
+}
+
+func appendMsgpackString(b []byte, value string) []byte {
+	switch n := len(value); {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda)
+		b = appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xdb)
+		b = appendUint32(b, uint32(n))
+	}
+	return append(b, value...)
+}
+
+func appendMsgpackBinary(b []byte, value []byte) []byte {
+	switch n := len(value); {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xc5)
+		b = appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xc6)
+		b = appendUint32(b, uint32(n))
+	}
+	return append(b, value...)
+}
+
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xdc)
+		return appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xdd)
+		return appendUint32(b, uint32(n))
+	}
+}
+
+func appendMsgpackMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xde)
+		return appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xdf)
+		return appendUint32(b, uint32(n))
+	}
+}
+
+// appendMsgpackEventTime appends t as the Fluent EventTime extension type:
+// seconds and nanoseconds as big endian 32 bit integers.
+func appendMsgpackEventTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xd7, 0x00)
+	b = appendUint32(b, uint32(t.Unix()))
+	return appendUint32(b, uint32(t.Nanosecond()))
+}
+
+// appendMsgpackJSON appends a value decoded by encoding/json with UseNumber.
+// Object keys are sorted.
+func appendMsgpackJSON(b []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return appendMsgpackNil(b)
+	case bool:
+		return appendMsgpackBool(b, v)
+	case string:
+		return appendMsgpackString(b, v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, i)
+		}
+		f, _ := v.Float64()
+		return appendMsgpackFloat(b, f)
+	case []interface{}:
+		b = appendMsgpackArrayHeader(b, len(v))
+		for _, element := range v {
+			b = appendMsgpackJSON(b, element)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		b = appendMsgpackMapHeader(b, len(v))
+		for _, key := range keys {
+			b = appendMsgpackString(b, key)
+			b = appendMsgpackJSON(b, v[key])
+		}
+		return b
+	default:
+		return appendMsgpackString(b, fmt.Sprint(v))
+	}
+}
+
+// msgpackDecoder reads single values from r without reading past them, so
+// that it can be used directly on a connection. Maps decode to
+// map[string]interface{}, strings and binary to string, integers to int64,
+// floats to float64 and EventTime to time.Time.
+type msgpackDecoder struct {
+	r       io.Reader
+	scratch [9]byte
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n > maxMsgpackLength {
+		return nil, errMsgpackTooLong
+	}
+
+	var buf []byte
+	if n <= len(d.scratch) {
+		buf = d.scratch[:n]
+	} else {
+		buf = make([]byte, n)
+	}
+
+	_, err := io.ReadFull(d.r, buf)
+	return buf, err
+}
+
+func (d *msgpackDecoder) length(size int) (int, error) {
+	buf, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+
+	switch size {
+	case 1:
+		return int(buf[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(buf)), nil
+	default:
+		return int(binary.BigEndian.Uint32(buf)), nil
+	}
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	buf, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	code := buf[0]
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return d.decodeMap(int(code & 0x0f))
+	case code&0xf0 == 0x90:
+		return d.decodeArray(int(code & 0x0f))
+	case code&0xe0 == 0xa0:
+		return d.decodeString(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		return d.decodeSized(1, d.decodeString)
+	case 0xc5, 0xda:
+		return d.decodeSized(2, d.decodeString)
+	case 0xc6, 0xdb:
+		return d.decodeSized(4, d.decodeString)
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		buf, err := d.read(1 << (code - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		var value uint64
+		for _, b := range buf {
+			value = value<<8 | uint64(b)
+		}
+		return int64(value), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		buf, err := d.read(size)
+		if err != nil {
+			return nil, err
+		}
+		value := int64(int8(buf[0]))
+		for _, b := range buf[1:] {
+			value = value<<8 | int64(b)
+		}
+		return value, nil
+	case 0xca:
+		buf, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(buf))), nil
+	case 0xcb:
+		buf, err := d.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(buf)), nil
+	case 0xd7:
+		buf, err := d.read(9)
+		if err != nil {
+			return nil, err
+		}
+		if buf[0] != 0 {
+			return nil, errMsgpackUnsupported
+		}
+		return time.Unix(int64(binary.BigEndian.Uint32(buf[1:5])), int64(binary.BigEndian.Uint32(buf[5:9]))), nil
+	case 0xdc:
+		return d.decodeSized(2, d.decodeArray)
+	case 0xdd:
+		return d.decodeSized(4, d.decodeArray)
+	case 0xde:
+		return d.decodeSized(2, d.decodeMap)
+	case 0xdf:
+		return d.decodeSized(4, d.decodeMap)
+	}
+
+	return nil, errMsgpackUnsupported
+}
+
+func (d *msgpackDecoder) decodeSized(size int, decode func(int) (interface{}, error)) (interface{}, error) {
+	n, err := d.length(size)
+	if err != nil {
+		return nil, err
+	}
+	return decode(n)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	buf, err := d.read(n)
+	return string(buf), err
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	if n > maxMsgpackLength {
+		return nil, errMsgpackTooLong
+	}
+
+	array := make([]interface{}, n)
+	for i := range array {
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		array[i] = value
+	}
+	return array, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	if n > maxMsgpackLength {
+		return nil, errMsgpackTooLong
+	}
+
+	object := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		object[fmt.Sprint(key)] = value
+	}
+	return object, nil
+}
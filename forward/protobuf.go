@@ -0,0 +1,52 @@
+package forward
+
+import (
+	"encoding/binary"
+)
+
+// Protocol buffer wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+// The append functions below encode just enough of the protocol buffer wire
+// format for the push APIs used by the forwarders, without generated code.
+// Nested messages are encoded into their own slice and appended with
+// appendProtoBytes.
+
+// appendUvarint is binary.AppendUvarint, which needs Go 1.19.
+func appendUvarint(b []byte, value uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], value)
+	return append(b, scratch[:n]...)
+}
+
+func appendProtoTag(b []byte, field int, wireType int) []byte {
+	return appendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoVarint(b []byte, field int, value uint64) []byte {
+	b = appendProtoTag(b, field, protoVarint)
+	return appendUvarint(b, value)
+}
+
+func appendProtoFixed64(b []byte, field int, value uint64) []byte {
+	b = appendProtoTag(b, field, protoFixed64)
+	var scratch [8]byte
+	binary.LittleEndian.PutUint64(scratch[:], value)
+	return append(b, scratch[:]...)
+}
+
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendProtoString(b []byte, field int, value string) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
@@ -0,0 +1,147 @@
+package forward
+
+import (
+	"bytes"
+	"errors"
+)
+
+type Status int
+
+const (
+	// StatusSuccess means the buffer was delivered.
+	StatusSuccess Status = iota
+	// StatusRetryable means delivery failed but may succeed if tried again.
+	StatusRetryable
+	// StatusPermanent means delivery failed and retrying will not help.
+	StatusPermanent
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusSuccess:
+		return "success"
+	case StatusRetryable:
+		return "retryable"
+	case StatusPermanent:
+		return "permanent"
+	default:
+		return "unknown"
+	}
+}
+
+// Result is the outcome of forwarding a single buffer. When Err is a
+// *PartialError, only its Remaining lines were not delivered.
+type Result struct {
+	Buffer *bytes.Buffer
+	Status Status
+	Err    error
+}
+
+// NewResult classifies the error returned by a Forwarder.
+func NewResult(buffer *bytes.Buffer, err error) Result {
+	result := Result{
+		Buffer: buffer,
+		Err:    err,
+	}
+
+	switch {
+	case err == nil:
+		result.Status = StatusSuccess
+	case IsPermanent(err):
+		result.Status = StatusPermanent
+	default:
+		result.Status = StatusRetryable
+	}
+
+	return result
+}
+
+// PermanentError marks a failure that will not succeed if retried, such as a
+// rejected API key or a malformed payload.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err in a PermanentError. It returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if IsPermanent(err) {
+		return err
+	}
+
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err, or any error it wraps, was marked with
+// Permanent.
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// PartialError reports a buffer that was only partly delivered. Remaining
+// holds the lines that were not accepted, which are all a retry should send so
+// that the delivered lines are not duplicated.
+type PartialError struct {
+	Remaining *bytes.Buffer
+	Err       error
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// Partial wraps err, the failure that stopped a buffer from being delivered in
+// full, in a PartialError holding a copy of the remaining lines. It returns
+// nil if err is nil.
+func Partial(remaining []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if partial, ok := err.(*PartialError); ok {
+		err = partial.Err
+	}
+
+	return &PartialError{
+		Remaining: bytes.NewBuffer(append([]byte(nil), remaining...)),
+		Err:       err,
+	}
+}
+
+// Remaining returns the part of buffer that was not delivered when forwarding
+// it failed with err: the Remaining lines of a PartialError, or the whole
+// buffer for any other error.
+func Remaining(buffer *bytes.Buffer, err error) *bytes.Buffer {
+	var partial *PartialError
+	if errors.As(err, &partial) {
+		return partial.Remaining
+	}
+
+	return buffer
+}
+
+// remainder is Remaining for a body that is not held in a buffer.
+func remainder(body []byte, err error) []byte {
+	var partial *PartialError
+	if errors.As(err, &partial) {
+		return partial.Remaining.Bytes()
+	}
+
+	return body
+}
@@ -0,0 +1,47 @@
+package forward
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Permanent errors should be recognized through wrapping
+func TestIsPermanent(test *testing.T) {
+	err := Permanent(errors.New("rejected"))
+
+	if !IsPermanent(err) || !IsPermanent(fmt.Errorf("forwarding: %w", err)) {
+		test.Fatal("expected the error to be permanent")
+	}
+
+	if IsPermanent(errors.New("timeout")) || IsPermanent(nil) {
+		test.Fatal("expected the error not to be permanent")
+	}
+
+	if NewResult(nil, fmt.Errorf("forwarding: %w", err)).Status != StatusPermanent {
+		test.Fatal("expected a permanent result")
+	}
+}
+
+// Partial errors should keep their status and expose the remaining lines
+func TestPartial(test *testing.T) {
+	buffer := bytes.NewBufferString("first\nsecond\n")
+
+	err := Partial([]byte("second\n"), errors.New("timeout"))
+	if IsPermanent(err) || Remaining(buffer, err).String() != "second\n" {
+		test.Fatalf("expected a retryable error for the second line, got %v", err)
+	}
+
+	if nested := Partial([]byte("second\n"), err); errors.Unwrap(nested) != errors.Unwrap(err) {
+		test.Fatal("expected partial errors not to be nested")
+	}
+
+	if !IsPermanent(Partial([]byte("second\n"), Permanent(errors.New("rejected")))) {
+		test.Fatal("expected the error to be permanent")
+	}
+
+	if Remaining(buffer, errors.New("timeout")) != buffer || Partial(nil, nil) != nil {
+		test.Fatal("expected other errors to leave the whole buffer")
+	}
+}
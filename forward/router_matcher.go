@@ -0,0 +1,149 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matcher decides whether a log line belongs to a route.
+type Matcher interface {
+	Match(line []byte) bool
+}
+
+// MatcherFunc allows an ordinary function to be used as a Matcher.
+type MatcherFunc func(line []byte) bool
+
+func (f MatcherFunc) Match(line []byte) bool {
+	return f(line)
+}
+
+// PrefixMatcher matches lines starting with prefix.
+func PrefixMatcher(prefix string) Matcher {
+	p := []byte(prefix)
+	return MatcherFunc(func(line []byte) bool {
+		return bytes.HasPrefix(line, p)
+	})
+}
+
+// RegexpMatcher matches lines containing a match of re.
+func RegexpMatcher(re *regexp.Regexp) Matcher {
+	return MatcherFunc(re.Match)
+}
+
+// JSONFieldMatcher matches JSON lines whose field equals value. Nested fields
+// are addressed with dots, e.g. "context.source", and non-string values are
+// compared using their JSON encoding, e.g. "true" or "42". A RouterForwarder
+// decodes each line once for all of its JSONFieldMatchers.
+func JSONFieldMatcher(field, value string) Matcher {
+	return &jsonFieldMatcher{
+		path:  strings.Split(field, "."),
+		value: value,
+	}
+}
+
+type jsonFieldMatcher struct {
+	path  []string
+	value string
+}
+
+func (m *jsonFieldMatcher) Match(line []byte) bool {
+	actual, ok := jsonField(line, m.path)
+	return ok && actual == m.value
+}
+
+func (m *jsonFieldMatcher) matchLine(line *routedLine) bool {
+	object, ok := line.object()
+	if !ok {
+		return false
+	}
+
+	actual, ok := objectField(object, m.path)
+	return ok && actual == m.value
+}
+
+// lineMatcher is implemented by matchers that can share the work of decoding
+// a line with the other matchers of a RouterForwarder.
+type lineMatcher interface {
+	matchLine(line *routedLine) bool
+}
+
+// routedLine is a line being matched against routes, decoded as JSON at most
+// once.
+type routedLine struct {
+	raw []byte
+
+	decoded bool
+	fields  map[string]interface{}
+}
+
+func (l *routedLine) object() (map[string]interface{}, bool) {
+	if !l.decoded {
+		l.decoded = true
+		l.fields, _ = jsonObject(l.raw)
+	}
+
+	return l.fields, l.fields != nil
+}
+
+func (l *routedLine) match(matcher Matcher) bool {
+	if m, ok := matcher.(lineMatcher); ok {
+		return m.matchLine(l)
+	}
+
+	return matcher.Match(l.raw)
+}
+
+// jsonField returns the value at path in a JSON object line as a string.
+func jsonField(line []byte, path []string) (string, bool) {
+	object, ok := jsonObject(line)
+	if !ok {
+		return "", false
+	}
+
+	return objectField(object, path)
+}
+
+// jsonObject decodes a line holding a JSON object.
+func jsonObject(line []byte) (map[string]interface{}, bool) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] != '{' {
+		return nil, false
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(line, &object); err != nil || object == nil {
+		return nil, false
+	}
+
+	return object, true
+}
+
+// objectField returns the value at path in a decoded JSON object as a string.
+func objectField(object map[string]interface{}, path []string) (string, bool) {
+	var current interface{} = object
+	for _, key := range path {
+		fields, ok := current.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+
+		if current, ok = fields[key]; !ok {
+			return "", false
+		}
+	}
+
+	switch v := current.(type) {
+	case string:
+		return v, true
+	case nil:
+		return "null", true
+	case map[string]interface{}, []interface{}:
+		encoded, _ := json.Marshal(v)
+		return string(encoded), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
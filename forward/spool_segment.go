@@ -0,0 +1,171 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	segmentMagic      = []byte("tspl")
+	segmentHeaderSize = 12
+	segmentExtension  = ".seg"
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptSegment = errors.New("spool: corrupt segment")
+)
+
+// segment is a single spooled buffer stored on disk as a 12 byte header (magic,
+// payload length and CRC-32C checksum) followed by the payload.
+type segment struct {
+	seq  uint64
+	path string
+	size int64
+}
+
+func segmentPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, segmentExtension))
+}
+
+// writeSegment writes payload to a temporary file and renames it into place
+// once synced, so that a crash never leaves a partially written segment. The
+// directory is synced too, so that the rename itself survives a crash.
+func writeSegment(dir string, seq uint64, payload []byte) (segment, error) {
+	path := segmentPath(dir, seq)
+	tmpPath := path + ".tmp"
+
+	header := make([]byte, segmentHeaderSize)
+	copy(header, segmentMagic)
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[8:12], crc32.Checksum(payload, crcTable))
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return segment{}, err
+	}
+
+	if _, err = file.Write(header); err == nil {
+		if _, err = file.Write(payload); err == nil {
+			err = file.Sync()
+		}
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return segment{}, err
+	}
+
+	if err := syncDir(dir); err != nil {
+		os.Remove(path)
+		return segment{}, err
+	}
+
+	return segment{
+		seq:  seq,
+		path: path,
+		size: int64(len(header) + len(payload)),
+	}, nil
+}
+
+// removeSegment deletes a segment and syncs its directory, so that a
+// delivered segment is not replayed after a crash.
+func removeSegment(seg segment) error {
+	if err := os.Remove(seg.path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(seg.path))
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// readSegment returns the payload of a segment after verifying its checksum.
+func readSegment(seg segment) (*bytes.Buffer, error) {
+	data, err := ioutil.ReadFile(seg.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < segmentHeaderSize || !bytes.Equal(data[:4], segmentMagic) {
+		return nil, errCorruptSegment
+	}
+
+	length := binary.BigEndian.Uint32(data[4:8])
+	checksum := binary.BigEndian.Uint32(data[8:12])
+	payload := data[segmentHeaderSize:]
+
+	if uint32(len(payload)) != length || crc32.Checksum(payload, crcTable) != checksum {
+		return nil, errCorruptSegment
+	}
+
+	return bytes.NewBuffer(payload), nil
+}
+
+// listSegments returns the segments in dir, oldest first, removing temporary
+// files left behind by an interrupted write.
+func listSegments(dir string) ([]segment, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, file := range files {
+		name := file.Name()
+
+		if strings.HasSuffix(name, segmentExtension+".tmp") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+
+		if !strings.HasSuffix(name, segmentExtension) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, segment{
+			seq:  seq,
+			path: filepath.Join(dir, name),
+			size: file.Size(),
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].seq < segments[j].seq
+	})
+
+	return segments, nil
+}
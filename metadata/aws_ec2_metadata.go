@@ -4,6 +4,8 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/timberio/timber-go/logging"
@@ -12,6 +14,12 @@ import (
 var (
 	defaultTimeout  = 1 * time.Second
 	defaultEndpoint = "http://169.254.169.254"
+
+	// IMDSv2 session tokens are requested for this long and renewed a minute
+	// before they expire. When no token can be fetched, requests fall back
+	// to IMDSv1 and a token is requested again after tokenRetryInterval.
+	tokenTTL           = 6 * time.Hour
+	tokenRetryInterval = 1 * time.Minute
 )
 
 type Config struct {
@@ -25,6 +33,10 @@ type EC2Client struct {
 	HTTPClient   *http.Client
 
 	Config
+
+	tokenMutex   sync.Mutex
+	token        string
+	tokenExpires time.Time
 }
 
 func DefaultConfig() Config {
@@ -116,7 +128,7 @@ func AddEC2Metadata(client *EC2Client, logEvent *LogEvent) {
 }
 
 func (client *EC2Client) Available() bool {
-	resp, err := client.HTTPClient.Get(client.BaseEndpoint + "/latest/meta-data/")
+	resp, err := client.get("/latest/meta-data/")
 
 	if err != nil {
 		return false
@@ -132,7 +144,7 @@ func (client *EC2Client) Available() bool {
 }
 
 func (client *EC2Client) GetMetadata(field string) (string, error) {
-	resp, err := client.HTTPClient.Get(client.BaseEndpoint + "/latest/meta-data/" + field)
+	resp, err := client.get("/latest/meta-data/" + field)
 
 	if err != nil {
 		return "", err
@@ -152,3 +164,69 @@ func (client *EC2Client) GetMetadata(field string) (string, error) {
 
 	return string(body[:]), nil
 }
+
+// get requests path from the metadata service, with an IMDSv2 session token
+// when one is available.
+func (client *EC2Client) get(path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", client.BaseEndpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if token := client.sessionToken(); token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	return client.HTTPClient.Do(req)
+}
+
+// sessionToken returns the current IMDSv2 session token, fetching a new one
+// when needed, or an empty string if the service does not provide one.
+func (client *EC2Client) sessionToken() string {
+	client.tokenMutex.Lock()
+	defer client.tokenMutex.Unlock()
+
+	now := time.Now()
+	if now.Before(client.tokenExpires) {
+		return client.token
+	}
+
+	token, err := client.fetchToken()
+	if err != nil {
+		client.token = ""
+		client.tokenExpires = now.Add(tokenRetryInterval)
+		return ""
+	}
+
+	client.token = token
+	client.tokenExpires = now.Add(tokenTTL - time.Minute)
+
+	return token
+}
+
+func (client *EC2Client) fetchToken() (string, error) {
+	req, err := http.NewRequest("PUT", client.BaseEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(tokenTTL/time.Second)))
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", errors.New("Did not receive a session token for EC2 metadata")
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
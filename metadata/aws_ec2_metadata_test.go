@@ -60,6 +60,12 @@ func TestEC2ClientGetMetadata(test *testing.T) {
 	expected := "i1934195190"
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Without IMDSv2, requests should fall back to IMDSv1
+		if r.Method == "PUT" {
+			w.WriteHeader(404)
+			return
+		}
+
 		expectedURI := "/latest/meta-data/instance-id"
 		if r.RequestURI != expectedURI {
 			test.Fatalf("Expected request URI to be %s, but got %s", expectedURI, r.RequestURI)
@@ -83,6 +89,48 @@ func TestEC2ClientGetMetadata(test *testing.T) {
 	}
 }
 
+// GetMetadata()
+// When the service requires IMDSv2, a session token should be fetched once and
+// sent with every request
+func TestEC2ClientGetMetadataToken(test *testing.T) {
+	expected := "i1934195190"
+	tokens := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/latest/api/token" && r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") != "" {
+			tokens++
+			w.Write([]byte("session-token"))
+			return
+		}
+
+		if r.Header.Get("X-aws-ec2-metadata-token") != "session-token" {
+			w.WriteHeader(401)
+			return
+		}
+
+		w.Write([]byte(expected))
+	}))
+
+	ec2Client := NewEC2Client(DefaultConfig())
+	ec2Client.BaseEndpoint = ts.URL
+
+	for i := 0; i < 2; i++ {
+		instanceID, err := ec2Client.GetMetadata("instance-id")
+
+		if err != nil {
+			test.Fatalf("Expected to get metadata, encountered error instead: %s", err)
+		}
+
+		if instanceID != expected {
+			test.Fatalf("Expected instance ID of %s, got %s instead", expected, instanceID)
+		}
+	}
+
+	if tokens != 1 {
+		test.Fatalf("Expected a single session token request, got %d", tokens)
+	}
+}
+
 // GetMetadata()
 // When the service is available, the metadata should be fetched and returned
 // Tests that the client properly handles a 404 from the service